@@ -0,0 +1,102 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"bytes"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ParseMetaAny parses buf as JSON, YAML, TOML, XML, the text notation or
+// the binary encoding. The format is chosen by the extension of the file
+// name, if given and known (.json, .yaml, .yml, .toml, .xml, .mp, .mpb), and
+// otherwise by the content.
+func ParseMetaAny(buf []byte, name ...string) (Meta, error) {
+	format := ""
+	if len(name) > 0 {
+		format = formatOfExt(filepath.Ext(name[0]))
+	}
+	if format == "" {
+		format = sniffFormat(buf)
+	}
+
+	switch format {
+	case "json":
+		return ParseMeta(buf)
+	case "yaml":
+		return ParseMetaYaml(buf)
+	case "toml":
+		return ParseMetaToml(buf)
+	case "xml":
+		return DecodeXml(buf)
+	case "binary":
+		return DecodeBinary(buf)
+	}
+	return ParseText(string(buf))
+}
+
+func formatOfExt(ext string) string {
+	switch strings.ToLower(ext) {
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	case ".xml":
+		return "xml"
+	case ".mp":
+		return "text"
+	case ".mpb":
+		return "binary"
+	}
+	return ""
+}
+
+// sniffFormat guesses from the first line that is not blank or a comment:
+// JSON starts with '{' or '[', XML with '<', TOML with `key =` or a table
+// header like `[table]` or `[[a.b]]` (bare keys only), YAML with `key:`,
+// "---" or "- "; anything else is the text notation.
+var tomlHeader = regexp.MustCompile(`^\[\[?[ \t]*[A-Za-z0-9_-]+([ \t]*\.[ \t]*[A-Za-z0-9_-]+)*[ \t]*\]\]?[ \t]*(#.*)?$`)
+
+func sniffFormat(buf []byte) string {
+	if bytes.HasPrefix(buf, []byte(binaryMagic)) {
+		return "binary"
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		switch {
+		case line[0] == '{':
+			return "json"
+		case line[0] == '<':
+			return "xml"
+		case line[0] == '[':
+			if tomlHeader.MatchString(line) {
+				return "toml"
+			}
+			return "json"
+		case line == "---" || strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "- "):
+			return "yaml"
+		}
+		key, rest := line, ""
+		if i := strings.IndexAny(line, ":= \t"); i >= 0 {
+			key, rest = line[:i], strings.TrimLeft(line[i:], " \t")
+		}
+		key = strings.Trim(key, `"'`)
+		if key != "" && strings.Trim(key, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-.") == "" {
+			if strings.HasPrefix(rest, "=") {
+				return "toml"
+			}
+			if rest == ":" || strings.HasPrefix(rest, ": ") || strings.HasPrefix(rest, ":\t") {
+				return "yaml"
+			}
+		}
+		return "text"
+	}
+	return "text"
+}
@@ -0,0 +1,435 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The binary encoding is a header "MPB\x01" followed by frames, each a
+// uvarint byte length and one node:
+//
+//	node  = 0x00 (Nil) | 0x01 kind:ref method:ref ns:ref gid:str
+//	        n (tag:ref value:ref)* n (attr:ref value:str)* payload:str
+//	        payloadType:ref n (sub:ref node)* n (rel:ref node)* n node*
+//	ref   = uvarint i, the (i-1)th string of the table, or 0 and a str
+//	        which is appended to the table
+//	str   = uvarint length, bytes
+//
+// where n is a uvarint count and names are sorted. Kinds, ns, methods, tag
+// names and values, and attr, sub and rel names go through the string
+// table, which persists across the frames of a stream; gids, attr values
+// and payloads, mostly unique, are written inline, payloads as raw bytes.
+// A frame of length 0 empties the string table.
+
+const binaryMagic = "MPB\x01"
+
+// MaxBinaryFrame is the default limit on the size of a decoded frame.
+const MaxBinaryFrame = 64 << 20
+
+// MaxBinaryStrings is the default size at which an encoder empties its
+// string table.
+const MaxBinaryStrings = 1 << 16
+
+const maxBinaryDepth = 10000
+
+func EncodeBinary(m Meta) []byte {
+	var buf bytesWriter
+	NewBinaryEncoder(&buf).Encode(m) // never fails
+	return buf
+}
+
+// DecodeBinary decodes the only Meta in buf.
+func DecodeBinary(buf []byte) (Meta, error) {
+	d := &BinaryDecoder{MaxFrame: len(buf)}
+	if err := d.readMagic(buf); err != nil {
+		return Nil, err
+	}
+	rest := buf[len(binaryMagic):]
+	size, n := binary.Uvarint(rest)
+	if n <= 0 || size != uint64(len(rest)-n) {
+		return Nil, errors.New("Invalid binary meta: bad frame length")
+	}
+	return d.decodeFrame(rest[n:])
+}
+
+type bytesWriter []byte
+
+func (w *bytesWriter) Write(p []byte) (int, error) {
+	*w = append(*w, p...)
+	return len(p), nil
+}
+
+type BinaryEncoder struct {
+	MaxStrings int // MaxBinaryStrings if 0
+
+	w       io.Writer
+	strs    map[string]int
+	added   []string // to strs by the frame being encoded
+	body    []byte
+	frame   []byte
+	started bool
+	reset   bool // to be told to the decoder
+}
+
+func NewBinaryEncoder(w io.Writer) *BinaryEncoder {
+	return &BinaryEncoder{w: w, strs: map[string]int{}}
+}
+
+// Encode writes m as one frame, the stream header before the first, in a
+// single Write. If it fails, the string table is as it was before, so later
+// frames still decode if nothing of this one was written.
+func (e *BinaryEncoder) Encode(m Meta) error {
+	max := e.MaxStrings
+	if max <= 0 {
+		max = MaxBinaryStrings
+	}
+	if len(e.strs) >= max {
+		e.Reset()
+	}
+	e.added = e.added[:0]
+	e.body = e.appendNode(e.body[:0], orNil(m), map[Meta]bool{})
+
+	frame := e.frame[:0]
+	if !e.started {
+		frame = append(frame, binaryMagic...)
+	}
+	if e.reset {
+		frame = append(frame, 0)
+	}
+	frame = appendUvarint(frame, uint64(len(e.body)))
+	frame = append(frame, e.body...)
+	e.frame = frame
+	if _, err := e.w.Write(frame); err != nil {
+		for _, s := range e.added {
+			delete(e.strs, s)
+		}
+		return err
+	}
+	e.started, e.reset = true, false
+	return nil
+}
+
+// Reset empties the string table, and the decoder's with the next frame.
+func (e *BinaryEncoder) Reset() {
+	e.strs = map[string]int{}
+	e.reset = true
+}
+
+// appendNode writes a node; one already on the path (a cycle) as a Ref
+func (e *BinaryEncoder) appendNode(buf []byte, m Meta, stack map[Meta]bool) []byte {
+	if m.IsNil() {
+		return append(buf, 0)
+	}
+	if stack[m] {
+		m = Ref(m)
+	}
+	stack[m] = true
+	defer delete(stack, m)
+
+	buf = append(buf, 1)
+	buf = e.appendRef(buf, m.Kind())
+	buf = e.appendRef(buf, m.Method())
+	buf = e.appendRef(buf, m.Ns())
+	buf = appendStr(buf, m.Gid())
+
+	names := m.TagNames()
+	buf = appendUvarint(buf, uint64(len(names)))
+	for _, name := range names {
+		buf = e.appendRef(buf, name)
+		buf = e.appendRef(buf, m.Tag(name))
+	}
+	names = m.AttrNames()
+	buf = appendUvarint(buf, uint64(len(names)))
+	for _, name := range names {
+		buf = e.appendRef(buf, name)
+		buf = appendStr(buf, m.Attr(name))
+	}
+	buf = appendStr(buf, m.Payload())
+	buf = e.appendRef(buf, m.PayloadType())
+
+	names = m.SubNames()
+	buf = appendUvarint(buf, uint64(len(names)))
+	for _, name := range names {
+		buf = e.appendRef(buf, name)
+		buf = e.appendNode(buf, m.Sub(name), stack)
+	}
+	names = m.RelNames()
+	buf = appendUvarint(buf, uint64(len(names)))
+	for _, name := range names {
+		buf = e.appendRef(buf, name)
+		buf = e.appendNode(buf, m.Rel(name), stack)
+	}
+	list := m.List()
+	buf = appendUvarint(buf, uint64(len(list)))
+	for _, item := range list {
+		buf = e.appendNode(buf, item, stack)
+	}
+	return buf
+}
+
+func (e *BinaryEncoder) appendRef(buf []byte, s string) []byte {
+	if idx, ok := e.strs[s]; ok {
+		return appendUvarint(buf, uint64(idx+1))
+	}
+	e.strs[s] = len(e.strs)
+	e.added = append(e.added, s)
+	return appendStr(append(buf, 0), s)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte { // binary.AppendUvarint needs go 1.19
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+func appendStr(buf []byte, s string) []byte {
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+type BinaryDecoder struct {
+	MaxFrame int // MaxBinaryFrame if 0
+
+	r       *bufio.Reader
+	strs    []string
+	started bool
+}
+
+func NewBinaryDecoder(r io.Reader) *BinaryDecoder {
+	return &BinaryDecoder{r: bufio.NewReader(r)}
+}
+
+// Decode reads the next frame; it returns io.EOF at the end of the stream.
+func (d *BinaryDecoder) Decode() (Meta, error) {
+	if !d.started {
+		magic := make([]byte, len(binaryMagic))
+		if _, err := io.ReadFull(d.r, magic); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = errors.New("Invalid binary meta: truncated header")
+			}
+			return Nil, err
+		}
+		if err := d.readMagic(magic); err != nil {
+			return Nil, err
+		}
+	}
+
+	size, err := d.frameSize()
+	if err != nil {
+		return Nil, err
+	}
+	max := d.MaxFrame
+	if max <= 0 {
+		max = MaxBinaryFrame
+	}
+	if size > uint64(max) {
+		return Nil, fmt.Errorf("Invalid binary meta: frame of %d bytes over %d", size, max)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(d.r, body); err != nil {
+		return Nil, errors.New("Invalid binary meta: truncated frame")
+	}
+	return d.decodeFrame(body)
+}
+
+// frameSize reads the next frame length, emptying the string table on 0
+func (d *BinaryDecoder) frameSize() (uint64, error) {
+	for {
+		size, err := binary.ReadUvarint(d.r)
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("Invalid binary meta: truncated frame length")
+		}
+		if err != nil || size > 0 {
+			return size, err
+		}
+		d.strs = nil
+	}
+}
+
+func (d *BinaryDecoder) readMagic(buf []byte) error {
+	if len(buf) < len(binaryMagic) || string(buf[:len(binaryMagic)]) != binaryMagic {
+		return errors.New("Invalid binary meta: bad header")
+	}
+	d.started = true
+	return nil
+}
+
+func (d *BinaryDecoder) decodeFrame(body []byte) (Meta, error) {
+	br := &binReader{body, 0, d}
+	m, err := br.node(0)
+	if err == nil && br.pos != len(body) {
+		err = br.errorf("%d trailing bytes", len(body)-br.pos)
+	}
+	if err != nil {
+		return Nil, err
+	}
+	return m, nil
+}
+
+type binReader struct {
+	buf []byte
+	pos int
+	d   *BinaryDecoder
+}
+
+func (br *binReader) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Invalid binary meta at %d: %s", br.pos, fmt.Sprintf(format, args...))
+}
+
+func (br *binReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(br.buf[br.pos:])
+	if n <= 0 {
+		return 0, br.errorf("bad uvarint")
+	}
+	br.pos += n
+	return v, nil
+}
+
+// count reads a count, bounded by the bytes left as each entry takes one
+func (br *binReader) count() (int, error) {
+	n, err := br.uvarint()
+	if err == nil && n > uint64(len(br.buf)-br.pos) {
+		err = br.errorf("count %d too large", n)
+	}
+	return int(n), err
+}
+
+func (br *binReader) str() (string, error) {
+	n, err := br.uvarint()
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(len(br.buf)-br.pos) {
+		return "", br.errorf("string of %d bytes past the end", n)
+	}
+	s := string(br.buf[br.pos : br.pos+int(n)])
+	br.pos += int(n)
+	return s, nil
+}
+
+func (br *binReader) ref() (string, error) {
+	idx, err := br.uvarint()
+	if err != nil {
+		return "", err
+	}
+	if idx == 0 {
+		s, err := br.str()
+		if err == nil {
+			br.d.strs = append(br.d.strs, s)
+		}
+		return s, err
+	}
+	if idx > uint64(len(br.d.strs)) {
+		return "", br.errorf("string ref %d not in table of %d", idx, len(br.d.strs))
+	}
+	return br.d.strs[idx-1], nil
+}
+
+func (br *binReader) node(depth int) (Meta, error) {
+	if depth > maxBinaryDepth {
+		return Nil, br.errorf("nested too deep")
+	}
+	if br.pos >= len(br.buf) {
+		return Nil, br.errorf("missing node")
+	}
+	switch br.buf[br.pos] {
+	case 0:
+		br.pos++
+		return Nil, nil
+	case 1:
+		br.pos++
+	default:
+		return Nil, br.errorf("bad node marker %d", br.buf[br.pos])
+	}
+
+	var kind, mthd, ns, gid, payload, ctype string
+	var err error
+	if kind, err = br.ref(); err != nil {
+		return Nil, err
+	}
+	if kind == "" {
+		return Nil, br.errorf("node without kind")
+	}
+	if mthd, err = br.ref(); err != nil {
+		return Nil, err
+	}
+	if ns, err = br.ref(); err != nil {
+		return Nil, err
+	}
+	if gid, err = br.str(); err != nil {
+		return Nil, err
+	}
+
+	tags, err := readEntries(br, br.ref)
+	if err != nil {
+		return Nil, err
+	}
+	attrs, err := readEntries(br, br.str)
+	if err != nil {
+		return Nil, err
+	}
+	if payload, err = br.str(); err != nil {
+		return Nil, err
+	}
+	if ctype, err = br.ref(); err != nil {
+		return Nil, err
+	}
+	if payload == "" && ctype != "" {
+		return Nil, br.errorf("payload type without payload")
+	}
+	child := func() (Meta, error) { return br.node(depth + 1) }
+	subs, err := readEntries(br, child)
+	if err != nil {
+		return Nil, err
+	}
+	rels, err := readEntries(br, child)
+	if err != nil {
+		return Nil, err
+	}
+
+	n, err := br.count()
+	if err != nil {
+		return Nil, err
+	}
+	var list []Meta
+	if n > 0 {
+		list = make([]Meta, n)
+	}
+	for i := range list {
+		if list[i], err = child(); err != nil {
+			return Nil, err
+		}
+	}
+
+	return &meta{
+		info{kind, mthd, ns, gid, pmapSorted(tags), pmapSorted(attrs), payloadData{payload, ctype}},
+		pmapSorted(subs),
+		pmapSorted(rels),
+		list,
+	}, nil
+}
+
+// readEntries reads a count and as many names and values, names in order
+func readEntries[V any](br *binReader, val func() (V, error)) ([]pentry[V], error) {
+	n, err := br.count()
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	ret := make([]pentry[V], n)
+	for i := range ret {
+		if ret[i].key, err = br.ref(); err != nil {
+			return nil, err
+		}
+		if i > 0 && ret[i].key <= ret[i-1].key {
+			return nil, br.errorf("name %q out of order", ret[i].key)
+		}
+		if ret[i].val, err = val(); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
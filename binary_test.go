@@ -0,0 +1,249 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// cyclicMeta is a node that is its own sub "self"
+type cyclicMeta struct {
+	Meta
+}
+
+func (c *cyclicMeta) SubNames() []string   { return []string{"self"} }
+func (c *cyclicMeta) SubCount() int        { return 1 }
+func (c *cyclicMeta) Sub(name string) Meta { return c }
+
+func TestBinaryRoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		m, want Meta
+	}{
+		{New("Doc").WithBytesPayload([]byte{0, 0xff, '\n'}, "image/png"), nil},
+		{New("Doc").WithPayload("text").WithAttr("empty", ""), nil},
+		{New("List").WithList([]Meta{New("A"), Nil, New("B")}, false), nil},
+		{benchOrder(3), nil},
+		{Nil, nil},
+		{
+			&cyclicMeta{New("Node", "", "ns", "n-1")},
+			New("Node", "", "ns", "n-1").WithSub("self", RefTo("Node", "ns", "n-1")),
+		},
+	} {
+		want := c.want
+		if want == nil {
+			want = c.m
+		}
+		got, err := DecodeBinary(EncodeBinary(c.m))
+		if err != nil {
+			t.Fatalf("%s: %v", CanonicalJson(want), err)
+		}
+		if !Equal(got, want) || got.PayloadType() != want.PayloadType() || len(got.List()) != len(want.List()) {
+			t.Errorf("got %s, want %s", CanonicalJson(got), CanonicalJson(want))
+		}
+	}
+}
+
+func TestBinaryStream(t *testing.T) {
+	ms := []Meta{benchOrder(2), New("Item").WithTag("status", "open"), Nil, benchOrder(1)}
+	var buf bytes.Buffer
+	e := NewBinaryEncoder(&buf)
+	ends := map[int]bool{len(binaryMagic): true} // where frames may end
+	for _, m := range ms {
+		if err := e.Encode(m); err != nil {
+			t.Fatal(err)
+		}
+		ends[buf.Len()] = true
+	}
+	stream := buf.Bytes()
+
+	d := NewBinaryDecoder(bytes.NewReader(stream))
+	for i, want := range ms {
+		got, err := d.Decode()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if !Equal(got, want) {
+			t.Errorf("frame %d: got %s", i, CanonicalJson(got))
+		}
+	}
+	if _, err := d.Decode(); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+
+	// a cut inside a frame fails; one between frames is a clean EOF
+	for n := 0; n < len(stream); n++ {
+		d := NewBinaryDecoder(bytes.NewReader(stream[:n]))
+		var err error
+		for err == nil {
+			_, err = d.Decode()
+		}
+		if (err == io.EOF) != (n == 0 || ends[n]) {
+			t.Errorf("cut at %d: %v", n, err)
+		}
+	}
+}
+
+func TestDecodeBinaryInvalid(t *testing.T) {
+	full := EncodeBinary(benchOrder(2))
+	for n := 0; n < len(full); n++ {
+		if _, err := DecodeBinary(full[:n]); err == nil {
+			t.Errorf("cut at %d accepted", n)
+		}
+	}
+
+	for _, c := range []struct {
+		body []byte
+		want string
+	}{
+		{[]byte{1, 3}, "string ref 3 not in table of 0"},
+		{[]byte{1, 0, 1, 'A', 2, 2}, "string ref 2 not in table of 1"},
+		{[]byte{1, 0, 1, 'A', 1, 1, 0, 0, 0, 0, 0, 0, 9}, "count 9 too large"},
+		{[]byte{2}, "bad node marker 2"},
+		{[]byte{0, 0}, "1 trailing bytes"},
+	} {
+		buf := appendUvarint([]byte(binaryMagic), uint64(len(c.body)))
+		_, err := DecodeBinary(append(buf, c.body...))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("% x: got %v, want %s", c.body, err, c.want)
+		}
+	}
+}
+
+// failWriter fails the writes numbered in fails, writing nothing
+type failWriter struct {
+	buf   bytes.Buffer
+	n     int
+	fails map[int]bool
+}
+
+func (w *failWriter) Write(p []byte) (int, error) {
+	w.n++
+	if w.fails[w.n] {
+		return 0, errors.New("write failed")
+	}
+	return w.buf.Write(p)
+}
+
+// A failed write leaves the string table as the decoder has it
+func TestBinaryEncoderWriteError(t *testing.T) {
+	w := &failWriter{fails: map[int]bool{1: true, 3: true}}
+	e := NewBinaryEncoder(w)
+	ms := []Meta{New("A").WithTag("t", "x"), New("B").WithTag("t", "y"), New("C"), New("B").WithTag("t", "x")}
+	var want []Meta
+	for i, m := range ms {
+		if err := e.Encode(m); err != nil != w.fails[i+1] {
+			t.Fatalf("frame %d: %v", i, err)
+		} else if err == nil {
+			want = append(want, m)
+		}
+	}
+
+	d := NewBinaryDecoder(&w.buf)
+	for i, m := range want {
+		got, err := d.Decode()
+		if err != nil || !Equal(got, m) {
+			t.Errorf("frame %d: got %v, %v, want %s", i, got, err, CanonicalJson(m))
+		}
+	}
+}
+
+// The encoder empties its string table at MaxStrings, and so does the
+// decoder with it
+func TestBinaryEncoderMaxStrings(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewBinaryEncoder(&buf)
+	e.MaxStrings = 10
+	var ms []Meta
+	for i := 0; i < 50; i++ {
+		ms = append(ms, New("Kind"+strconv.Itoa(i)).WithTag("status", "open", "n", strconv.Itoa(i%3)))
+		if err := e.Encode(ms[i]); err != nil {
+			t.Fatal(err)
+		}
+		if len(e.strs) > 10+5 {
+			t.Fatalf("%d strings in the table", len(e.strs))
+		}
+	}
+	e.Reset()
+	ms = append(ms, New("Kind0"))
+	if err := e.Encode(ms[50]); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewBinaryDecoder(&buf)
+	for i, m := range ms {
+		got, err := d.Decode()
+		if err != nil || !Equal(got, m) {
+			t.Fatalf("frame %d: got %v, %v, want %s", i, got, err, CanonicalJson(m))
+		}
+	}
+	if len(d.strs) != 2 { // "Kind0" and ""
+		t.Errorf("decoder table %v", d.strs)
+	}
+}
+
+// benchOrder is an order of n items, repeating kinds and names as mpi
+// traffic does
+func benchOrder(n int) Meta {
+	items := make([]Meta, n)
+	for i := range items {
+		items[i] = New("Item", "", "shop", "item-"+strconv.Itoa(i)).
+			WithTag("status", "open").
+			WithAttr("sku", "SKU-"+strconv.Itoa(i%50), "qty", strconv.Itoa(i%7+1), "price", "19.99").
+			WithSub("product", New("Product").WithAttr("name", "Product "+strconv.Itoa(i%50)))
+	}
+	return New("Order", "create", "shop", "order-1").
+		WithAttr("customer", "c-42", "currency", "EUR").
+		WithSub("customer", New("Customer").WithAttr("name", "Ada", "email", "ada@example.com")).
+		WithList(items)
+}
+
+func BenchmarkEncodeBinary(b *testing.B) {
+	m := benchOrder(100)
+	b.ReportAllocs()
+	b.ReportMetric(float64(len(EncodeBinary(m))), "B/meta")
+	for i := 0; i < b.N; i++ {
+		EncodeBinary(m)
+	}
+}
+
+func BenchmarkDecodeBinary(b *testing.B) {
+	buf := EncodeBinary(benchOrder(100))
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	b.ReportMetric(float64(len(buf)), "B/meta")
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodeBinary(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeJson(b *testing.B) {
+	m := benchOrder(100)
+	buf, _ := json.Marshal(MetaToJson(m))
+	b.ReportAllocs()
+	b.ReportMetric(float64(len(buf)), "B/meta")
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(MetaToJson(m)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeJson(b *testing.B) {
+	buf, _ := json.Marshal(MetaToJson(benchOrder(100)))
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	b.ReportMetric(float64(len(buf)), "B/meta")
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseMeta(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+// Builder constructs a Meta by mutation, avoiding the copy per With* call.
+// It is not safe for concurrent use. Build freezes the current state into
+// an immutable Meta; the builder may keep being used afterwards without
+// affecting what was built.
+type Builder struct {
+	kind, mthd, ns, gid string
+
+	tags    map[string]string
+	attrs   map[string]string
+	payload payloadData
+
+	subs map[string]builderItem
+	rels map[string]builderItem
+	list []builderItem
+}
+
+// builderItem is either a finished Meta or a nested builder
+type builderItem struct {
+	m Meta
+	b *Builder
+}
+
+func (item builderItem) build() Meta {
+	if item.b != nil {
+		return item.b.Build()
+	}
+	return item.m
+}
+
+// NewBuilder takes the same arguments as New.
+func NewBuilder(kind string, args ...string) *Builder {
+	var mthd, ns, gid string
+	switch len(args) {
+	case 0:
+	case 1:
+		mthd = args[0]
+	case 2:
+		mthd, ns = args[0], args[1]
+	default:
+		mthd, ns, gid = args[0], args[1], args[2]
+	}
+	return &Builder{kind: kind, mthd: mthd, ns: ns, gid: gid}
+}
+
+// BuilderFrom starts a builder with the content of m.
+func BuilderFrom(m Meta) *Builder {
+	b := NewBuilder(m.Kind(), m.Method(), m.Ns(), m.Gid()).
+		SetTags(CopyTags(m)).
+		SetAttrs(CopyAttrs(m))
+	b.payload = payloadData{m.Payload(), m.PayloadType()}
+	for _, name := range m.SubNames() {
+		b.SetSub(name, m.Sub(name))
+	}
+	for _, name := range m.RelNames() {
+		b.SetRel(name, m.Rel(name))
+	}
+	return b.AppendList(m.List()...)
+}
+
+func (b *Builder) SetMethod(mthd string) *Builder {
+	b.mthd = mthd
+	return b
+}
+
+func (b *Builder) SetGid(gid string) *Builder {
+	b.gid = gid
+	return b
+}
+
+func (b *Builder) SetTag(name, value string) *Builder {
+	if b.tags == nil {
+		b.tags = map[string]string{}
+	}
+	b.tags[name] = value
+	return b
+}
+
+func (b *Builder) SetTags(ts map[string]string) *Builder {
+	for k, v := range ts {
+		b.SetTag(k, v)
+	}
+	return b
+}
+
+func (b *Builder) DeleteTag(name string) *Builder {
+	delete(b.tags, name)
+	return b
+}
+
+func (b *Builder) SetAttr(name, value string) *Builder {
+	if b.attrs == nil {
+		b.attrs = map[string]string{}
+	}
+	b.attrs[name] = value
+	return b
+}
+
+func (b *Builder) SetAttrs(ts map[string]string) *Builder {
+	for k, v := range ts {
+		b.SetAttr(k, v)
+	}
+	return b
+}
+
+func (b *Builder) DeleteAttr(name string) *Builder {
+	delete(b.attrs, name)
+	return b
+}
+
+func (b *Builder) SetPayload(payload string) *Builder {
+	b.payload = payloadData{data: payload}
+	return b
+}
+
+// SetBytesPayload is as WithBytesPayload; empty data clears the payload
+// and its type.
+func (b *Builder) SetBytesPayload(data []byte, contentType string) *Builder {
+	b.payload = payloadData{}
+	if len(data) > 0 {
+		if contentType == "" {
+			contentType = DefaultPayloadType
+		}
+		b.payload = payloadData{string(data), contentType}
+	}
+	return b
+}
+
+// SetSub sets a finished sub; nil is ignored, as by WithSub.
+func (b *Builder) SetSub(name string, sub Meta) *Builder {
+	if sub != nil {
+		b.subs = setBuilderItem(b.subs, name, builderItem{m: sub})
+	}
+	return b
+}
+
+// Sub returns the nested builder for sub name. A finished sub already set
+// is carried over with BuilderFrom; if there is none, the builder is created
+// with the New arguments.
+func (b *Builder) Sub(name, kind string, args ...string) *Builder {
+	var nested *Builder
+	b.subs, nested = nestedBuilder(b.subs, name, kind, args)
+	return nested
+}
+
+func (b *Builder) DeleteSub(name string) *Builder {
+	delete(b.subs, name)
+	return b
+}
+
+func (b *Builder) SetRel(name string, rel Meta) *Builder {
+	if rel != nil {
+		b.rels = setBuilderItem(b.rels, name, builderItem{m: rel})
+	}
+	return b
+}
+
+// Rel returns the nested builder for rel name, as Sub does.
+func (b *Builder) Rel(name, kind string, args ...string) *Builder {
+	var nested *Builder
+	b.rels, nested = nestedBuilder(b.rels, name, kind, args)
+	return nested
+}
+
+func (b *Builder) DeleteRel(name string) *Builder {
+	delete(b.rels, name)
+	return b
+}
+
+func nestedBuilder(items map[string]builderItem, name, kind string, args []string) (map[string]builderItem, *Builder) {
+	item := items[name]
+	if item.b != nil {
+		return items, item.b
+	}
+	if item.m != nil && !item.m.IsNil() {
+		item.b = BuilderFrom(item.m)
+	} else {
+		item.b = NewBuilder(kind, args...)
+	}
+	item.m = nil
+	return setBuilderItem(items, name, item), item.b
+}
+
+func setBuilderItem(items map[string]builderItem, name string, item builderItem) map[string]builderItem {
+	if items == nil {
+		items = map[string]builderItem{}
+	}
+	items[name] = item
+	return items
+}
+
+// AppendList appends items, keeping Nil in place of nil.
+func (b *Builder) AppendList(items ...Meta) *Builder {
+	for _, item := range items {
+		b.list = append(b.list, builderItem{m: orNil(item)})
+	}
+	return b
+}
+
+// AppendItem appends a nested builder for a new list item.
+func (b *Builder) AppendItem(kind string, args ...string) *Builder {
+	item := NewBuilder(kind, args...)
+	b.list = append(b.list, builderItem{b: item})
+	return item
+}
+
+func (b *Builder) ListLen() int {
+	return len(b.list)
+}
+
+func (b *Builder) Build() Meta {
+	if b.kind == "" {
+		return Nil
+	}
+
+	var list []Meta
+	if len(b.list) > 0 {
+		list = make([]Meta, len(b.list))
+		for i, item := range b.list {
+			list[i] = item.build()
+		}
+	}
+	return &meta{
+		info{b.kind, b.mthd, b.ns, b.gid, pmapOf(b.tags), pmapOf(b.attrs), b.payload},
+		buildItems(b.subs),
+		buildItems(b.rels),
+		list,
+	}
+}
+
+func buildItems(items map[string]builderItem) metaMap {
+	if len(items) == 0 {
+		return metaMap{}
+	}
+	ms := make(map[string]Meta, len(items))
+	for name, item := range items {
+		ms[name] = item.build()
+	}
+	return pmapOf(ms)
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jyrobin/mp"
+)
+
+// kindDef collects what is known of one kind from schemas and samples
+type kindDef struct {
+	kind, ns string
+	name     string            // Go type
+	attrs    map[string]string // name -> schema type
+	tags     map[string]bool
+	subs     map[string]string // name -> kind
+	rels     map[string]string
+	hasList  bool
+	listKind string // "" if unknown or mixed
+}
+
+type generator struct {
+	defs  map[string]*kindDef // by ns:kind
+	order []*kindDef
+	names map[string]bool
+}
+
+func newGenerator() *generator {
+	return &generator{defs: map[string]*kindDef{}, names: map[string]bool{}}
+}
+
+func (g *generator) def(kind, ns string) *kindDef {
+	key := ns + ":" + kind
+	if d, ok := g.defs[key]; ok {
+		return d
+	}
+	name := goName(kind)
+	if g.names[name] {
+		name = goName(ns) + name
+	}
+	for i := 2; g.names[name]; i++ {
+		name = goName(kind) + strconv.Itoa(i)
+	}
+	g.names[name] = true
+
+	d := &kindDef{
+		kind: kind, ns: ns, name: name,
+		attrs: map[string]string{}, tags: map[string]bool{},
+		subs: map[string]string{}, rels: map[string]string{},
+	}
+	g.defs[key] = d
+	g.order = append(g.order, d)
+	return d
+}
+
+// Add takes a Schema Meta or a sample Meta.
+func (g *generator) Add(m mp.Meta) error {
+	if m.Kind() == "Schema" {
+		_, err := g.addSchema(m)
+		return err
+	}
+	g.addSample(m)
+	return nil
+}
+
+func (g *generator) addSchema(m mp.Meta) (string, error) {
+	kind := m.Tag("kind")
+	if kind == "" {
+		return "", fmt.Errorf("Schema without kind")
+	}
+	d := g.def(kind, m.Tag("ns"))
+	for idx, item := range m.List() {
+		name := item.Attr("name")
+		switch item.Kind() {
+		case "Attr":
+			d.attrs[name] = item.Attr("type", "string")
+		case "Tag":
+			d.tags[name] = true
+		case "Sub", "Rel":
+			kind := item.Attr("kind")
+			if item.HasSub("schema") {
+				k, err := g.addSchema(item.Sub("schema"))
+				if err != nil {
+					return "", fmt.Errorf("Schema %s field #%d: %v", d.kind, idx, err)
+				}
+				if kind == "" {
+					kind = k
+				}
+			}
+			if item.Kind() == "Sub" {
+				d.subs[name] = kind
+			} else {
+				d.rels[name] = kind
+			}
+		case "List":
+			d.hasList = true
+			if kinds := item.Attr("kind"); !strings.Contains(kinds, ",") {
+				d.listKind = kinds
+			}
+			if item.HasSub("schema") {
+				k, err := g.addSchema(item.Sub("schema"))
+				if err != nil {
+					return "", fmt.Errorf("Schema %s list: %v", d.kind, err)
+				}
+				if d.listKind == "" {
+					d.listKind = k
+				}
+			}
+		default:
+			return "", fmt.Errorf("Schema %s field #%d: unknown field kind %s", d.kind, idx, item.Kind())
+		}
+	}
+	return kind, nil
+}
+
+func (g *generator) addSample(m mp.Meta) {
+	if m.IsNil() {
+		return
+	}
+	d := g.def(m.Kind(), m.Ns())
+	for _, name := range m.AttrNames() {
+		typ := sampleType(m.Attr(name))
+		if old, ok := d.attrs[name]; ok && old != typ {
+			if old == "int" && typ == "float" || old == "float" && typ == "int" {
+				typ = "float"
+			} else {
+				typ = "string"
+			}
+		}
+		d.attrs[name] = typ
+	}
+	for _, name := range m.TagNames() {
+		d.tags[name] = true
+	}
+	for _, name := range m.SubNames() {
+		sub := m.Sub(name)
+		d.subs[name] = sub.Kind()
+		g.addSample(sub)
+	}
+	for _, name := range m.RelNames() {
+		rel := m.Rel(name)
+		if mp.IsRef(rel) {
+			d.rels[name] = rel.Tag("kind")
+		} else {
+			d.rels[name] = rel.Kind()
+			g.addSample(rel)
+		}
+	}
+
+	list := m.List()
+	for idx, item := range list {
+		g.addSample(item)
+		switch {
+		case !d.hasList && idx == 0:
+			d.listKind = item.Kind()
+		case d.listKind != item.Kind():
+			d.listKind = ""
+		}
+	}
+	if len(list) > 0 {
+		d.hasList = true
+	}
+}
+
+// sampleType guesses the schema type of an attr value
+func sampleType(val string) string {
+	if val == "true" || val == "false" {
+		return "bool"
+	}
+	if _, err := strconv.Atoi(val); err == nil {
+		return "int"
+	}
+	if _, err := strconv.ParseFloat(val, 64); err == nil {
+		return "float"
+	}
+	if _, err := time.Parse(mp.UtcTimeFormat, val); err == nil {
+		return "utc"
+	}
+	if _, err := time.Parse(mp.UtcDateFormat, val); err == nil {
+		return "date"
+	}
+	return "string"
+}
+
+// goName turns names like "first_name" into "FirstName"
+func goName(s string) string {
+	var sb strings.Builder
+	upper := true
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if sb.Len() == 0 && unicode.IsDigit(r) {
+			sb.WriteByte('X')
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		sb.WriteRune(r)
+	}
+	if sb.Len() == 0 {
+		return "X"
+	}
+	return sb.String()
+}
+
+// methods of the embedded Meta, which wrapper methods must not shadow
+var reserved = func() map[string]bool {
+	ret := map[string]bool{"Meta": true}
+	t := reflect.TypeOf((*mp.Meta)(nil)).Elem()
+	for i := 0; i < t.NumMethod(); i++ {
+		ret[t.Method(i).Name] = true
+	}
+	return ret
+}()
+
+type attrAccess struct {
+	goType, get, set string // get (a body) and set are formats taking the name
+}
+
+var attrAccesses = map[string]attrAccess{
+	"string": {"string", "return m.Attr(%q)", "m.WithAttr(%q, v)"},
+	"enum":   {"string", "return m.Attr(%q)", "m.WithAttr(%q, v)"},
+	"regex":  {"string", "return m.Attr(%q)", "m.WithAttr(%q, v)"},
+	"int":    {"int", "return m.IntAttrOr(%q, 0)", "m.WithIntAttr(%q, v)"},
+	"bool":   {"bool", "return m.BoolAttrOr(%q, false)", "m.WithBoolAttr(%q, v)"},
+	"float":  {"float64", "return m.FloatAttrOr(%q, 0)", "m.WithFloatAttr(%q, v)"},
+	"date":   {"time.Time", "t, _ := m.DateAttr(%q)\n\treturn t", "m.WithDateAttr(%q, v)"},
+	"utc":    {"time.Time", "return m.UtcAttr(%q)", "m.WithUtcAttr(%q, v)"},
+}
+
+// Generate writes the wrappers as gofmt'ed Go.
+func (g *generator) Generate(pkg string) ([]byte, error) {
+	var body bytes.Buffer
+	usesTime := false
+	for _, d := range g.order {
+		if g.writeKind(&body, d) {
+			usesTime = true
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by mpgen. DO NOT EDIT.\n\npackage %s\n\nimport (\n", pkg)
+	if usesTime {
+		buf.WriteString("\t\"time\"\n\n")
+	}
+	buf.WriteString("\t\"github.com/jyrobin/mp\"\n)\n")
+	body.WriteTo(&buf)
+	return format.Source(buf.Bytes())
+}
+
+// GenerateActors writes actor stubs for methods, meant to be filled in, so
+// not marked as generated.
+func (g *generator) GenerateActors(pkg string, methods []string) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "package %s\n\nimport (\n\t\"context\"\n\t\"errors\"\n\n\t\"github.com/jyrobin/mp\"\n)\n", pkg)
+	for _, d := range g.order {
+		writeActors(&buf, d, methods)
+	}
+	return format.Source(buf.Bytes())
+}
+
+// writeKind reports if time is used
+func (g *generator) writeKind(w *bytes.Buffer, d *kindDef) bool {
+	n := d.name
+	fmt.Fprintf(w, "\n// %s wraps a Meta of kind %s", n, d.kind)
+	if d.ns != "" {
+		fmt.Fprintf(w, " in ns %s", d.ns)
+	}
+	fmt.Fprintf(w, ".\ntype %s struct {\n\tmp.Meta\n}\n\n", n)
+	fmt.Fprintf(w, "const (\n\t%sKind = %q\n\t%sNs = %q\n)\n\n", n, d.kind, n, d.ns)
+	fmt.Fprintf(w, "func New%s(gid ...string) %s {\n", n, n)
+	fmt.Fprintf(w, "\tid := \"\"\n\tif len(gid) > 0 {\n\t\tid = gid[0]\n\t}\n")
+	fmt.Fprintf(w, "\treturn %s{mp.New(%sKind, \"\", %sNs, id)}\n}\n\n", n, n, n)
+	fmt.Fprintf(w, "// As%s wraps m if it has the kind and ns of %s.\n", n, n)
+	fmt.Fprintf(w, "func As%s(m mp.Meta) (%s, bool) {\n", n, n)
+	fmt.Fprintf(w, "\treturn %s{m}, m != nil && m.Kind() == %sKind && m.Ns() == %sNs\n}\n", n, n, n)
+
+	used := map[string]bool{}
+	pick := func(name, suffix string) string {
+		base := goName(name)
+		for i := 1; ; i++ {
+			cand := base
+			if i > 1 {
+				cand += suffix
+			}
+			if i > 2 {
+				cand += strconv.Itoa(i - 1)
+			}
+			if !used[cand] && !reserved[cand] && !used["With"+cand] && !reserved["With"+cand] {
+				used[cand], used["With"+cand] = true, true
+				return cand
+			}
+		}
+	}
+
+	usesTime := false
+	for _, name := range sortedKeys(d.attrs) {
+		acc, ok := attrAccesses[d.attrs[name]]
+		if !ok {
+			acc = attrAccesses["string"]
+		}
+		if acc.goType == "time.Time" {
+			usesTime = true
+		}
+		fn := pick(name, "Attr")
+		fmt.Fprintf(w, "\nfunc (m %s) %s() %s {\n", n, fn, acc.goType)
+		fmt.Fprintf(w, "\t"+acc.get+"\n}\n", name)
+		fmt.Fprintf(w, "\nfunc (m %s) With%s(v %s) %s {\n", n, fn, acc.goType, n)
+		fmt.Fprintf(w, "\treturn %s{"+acc.set+"}\n}\n", n, name)
+	}
+	for _, name := range sortedKeys(d.tags) {
+		fn := pick(name, "Tag")
+		fmt.Fprintf(w, "\nfunc (m %s) %s() string {\n\treturn m.Tag(%q)\n}\n", n, fn, name)
+		fmt.Fprintf(w, "\nfunc (m %s) With%s(v string) %s {\n\treturn %s{m.WithTag(%q, v)}\n}\n", n, fn, n, n, name)
+	}
+	for _, role := range []string{"Sub", "Rel"} {
+		nodes := d.subs
+		if role == "Rel" {
+			nodes = d.rels
+		}
+		for _, name := range sortedKeys(nodes) {
+			fn := pick(name, role)
+			typ, get, set := g.wrapper(nodes[name], d.ns), "m."+role+"(%q)", "v"
+			if typ != "mp.Meta" {
+				get, set = typ+"{"+get+"}", "v.Meta"
+			}
+			fmt.Fprintf(w, "\nfunc (m %s) %s() %s {\n\treturn "+get+"\n}\n", n, fn, typ, name)
+			fmt.Fprintf(w, "\nfunc (m %s) With%s(v %s) %s {\n\treturn %s{m.With%s(%q, %s)}\n}\n",
+				n, fn, typ, n, n, role, name, set)
+		}
+	}
+
+	if d.hasList {
+		fn := pick("items", "List")
+		typ := g.wrapper(d.listKind, d.ns)
+		fmt.Fprintf(w, "\nfunc (m %s) %s() []%s {\n", n, fn, typ)
+		if typ == "mp.Meta" {
+			fmt.Fprintf(w, "\treturn m.List()\n}\n")
+		} else {
+			fmt.Fprintf(w, "\tlist := m.List()\n\tret := make([]%s, len(list))\n", typ)
+			fmt.Fprintf(w, "\tfor i, item := range list {\n\t\tret[i] = %s{item}\n\t}\n\treturn ret\n}\n", typ)
+		}
+		fmt.Fprintf(w, "\nfunc (m %s) With%s(items ...%s) %s {\n", n, fn, typ, n)
+		if typ == "mp.Meta" {
+			fmt.Fprintf(w, "\treturn %s{m.WithList(items)}\n}\n", n)
+		} else {
+			fmt.Fprintf(w, "\tlist := make([]mp.Meta, len(items))\n")
+			fmt.Fprintf(w, "\tfor i, item := range items {\n\t\tlist[i] = item.Meta\n\t}\n")
+			fmt.Fprintf(w, "\treturn %s{m.WithList(list)}\n}\n", n)
+		}
+	}
+	return usesTime
+}
+
+// wrapper returns the Go type for kind, preferring the same ns
+func (g *generator) wrapper(kind, ns string) string {
+	if kind == "" {
+		return "mp.Meta"
+	}
+	if d, ok := g.defs[ns+":"+kind]; ok {
+		return d.name
+	}
+	for _, d := range g.order {
+		if d.kind == kind {
+			return d.name
+		}
+	}
+	return "mp.Meta"
+}
+
+func writeActors(w *bytes.Buffer, d *kindDef, methods []string) {
+	n := d.name
+	fmt.Fprintf(w, "\n// %sActors implements the methods of %s; see %sActorList.\n", n, n, n)
+	fmt.Fprintf(w, "type %sActors struct{}\n\n", n)
+	fmt.Fprintf(w, "func %sActorList(a *%sActors) []mp.Actor {\n\treturn mp.ReflectActorList(a, %sKind)\n}\n", n, n, n)
+	for _, mthd := range methods {
+		fmt.Fprintf(w, "\nfunc (a *%sActors) Mpi%s(ctx context.Context, m mp.Meta, opts ...mp.Meta) (mp.Meta, error) {\n", n, goName(mthd))
+		fmt.Fprintf(w, "\treturn mp.Nil, errors.New(\"%s.%s not implemented\")\n}\n", n, mthd)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
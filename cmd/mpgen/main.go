@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/jyrobin/mp"
+)
+
+// mpgen generates typed Go wrappers from Schema Metas or sample Metas, given
+// as JSON files (a Meta or an array of them), or on stdin.
+func main() {
+	pkgFlag := flag.String("pkg", "main", "Package name")
+	outFlag := flag.String("o", "", "Output file, stdout if empty")
+	actorsFlag := flag.String("actors", "", "Comma-separated methods to generate actor stubs for, e.g. find,list")
+	stubsFlag := flag.String("stubs", "", "Output file of the actor stubs")
+	flag.Parse()
+
+	var methods []string
+	for _, mthd := range strings.Split(*actorsFlag, ",") {
+		if mthd = strings.TrimSpace(mthd); mthd != "" {
+			methods = append(methods, mthd)
+		}
+	}
+	if len(methods) > 0 && *stubsFlag == "" {
+		fmt.Println("Flag -actors needs -stubs")
+		os.Exit(1)
+	}
+
+	g := newGenerator()
+	files := flag.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, file := range files {
+		if err := addFile(g, file); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	src, err := g.Generate(*pkgFlag)
+	if err == nil {
+		err = output(*outFlag, src)
+	}
+	if err == nil && len(methods) > 0 {
+		if src, err = g.GenerateActors(*pkgFlag, methods); err == nil {
+			err = output(*stubsFlag, src)
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func output(file string, src []byte) error {
+	if file == "" {
+		_, err := os.Stdout.Write(src)
+		return err
+	}
+	return ioutil.WriteFile(file, src, 0644)
+}
+
+func addFile(g *generator, file string) error {
+	var buf []byte
+	var err error
+	if file == "-" {
+		buf, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		buf, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return err
+	}
+
+	var ms []mp.Meta
+	if trimmed := strings.TrimSpace(string(buf)); strings.HasPrefix(trimmed, "[") {
+		var mjs []mp.MetaJson
+		if err := json.Unmarshal(buf, &mjs); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		ms = mp.JsonsToMetas(mjs)
+	} else {
+		m, err := mp.ParseMeta(buf)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		ms = []mp.Meta{m}
+	}
+
+	for _, m := range ms {
+		if err := g.Add(m); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	return nil
+}
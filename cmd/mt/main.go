@@ -10,7 +10,7 @@ import (
 	"github.com/jyrobin/mp"
 )
 
-func mt(buf []byte, kind, tags, attrs string) error {
+func mt(buf []byte, kind, tags, attrs, query string) error {
 	m, err := mp.ParseMeta(buf)
 	if err != nil {
 		return err
@@ -36,6 +36,16 @@ func mt(buf []byte, kind, tags, attrs string) error {
 		}
 	}
 
+	if query != "" {
+		ms, err := mp.Query(m, query)
+		if err != nil {
+			return err
+		}
+		if len(ms) == 0 {
+			return fmt.Errorf("Got no match, expected query %s", query)
+		}
+	}
+
 	return nil
 }
 
@@ -44,6 +54,7 @@ func main() {
 	kindFlag := flag.String("kind", "", "Kind")
 	tagsFlag := flag.String("tags", "", "Tags")
 	attrsFlag := flag.String("attrs", "", "Attrs")
+	queryFlag := flag.String("query", "", "Query with at least one match")
 	flag.Parse()
 
 	buf, err := ioutil.ReadAll(os.Stdin)
@@ -52,7 +63,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err := mt(buf, *kindFlag, *tagsFlag, *attrsFlag); err != nil {
+	if err := mt(buf, *kindFlag, *tagsFlag, *attrsFlag, *queryFlag); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
@@ -0,0 +1,250 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"encoding"
+	"fmt"
+	"math/big"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// An attr codec converts values of one Go type to and from attr strings.
+// Besides registered codecs, types implementing encoding.TextMarshaler and
+// encoding.TextUnmarshaler, and types whose underlying type is a bool,
+// string, int, uint or float, are supported.
+type attrCodec struct {
+	format func(v reflect.Value) (string, error)
+	parse  func(s string) (reflect.Value, error)
+}
+
+var (
+	codecMu sync.RWMutex
+	codecs  = map[reflect.Type]attrCodec{}
+)
+
+// RegisterCodec sets the codec for T, replacing any previous one, e.g. for
+// IDs, money or geo points. Parse errors are reported by the attr readers
+// as AttrError.
+func RegisterCodec[T any](format func(v T) string, parse func(s string) (T, error)) {
+	registerCodec(func(v T) (string, error) { return format(v), nil }, parse)
+}
+
+// registerCodec is RegisterCodec for formats that may fail
+func registerCodec[T any](format func(v T) (string, error), parse func(s string) (T, error)) {
+	c := attrCodec{
+		format: func(v reflect.Value) (string, error) {
+			if v.Kind() == reflect.Pointer && v.IsNil() {
+				return "", nil
+			}
+			x, _ := v.Interface().(T)
+			return format(x)
+		},
+		parse: func(s string) (reflect.Value, error) {
+			x, err := parse(s)
+			return reflect.ValueOf(&x).Elem(), err
+		},
+	}
+
+	codecMu.Lock()
+	defer codecMu.Unlock()
+	codecs[typeOf[T]()] = c
+}
+
+func init() {
+	RegisterCodec(formatUtc, parseUtc)
+	RegisterCodec(time.Duration.String, time.ParseDuration)
+	registerCodec(formatDecimal, parseDecimal)
+	RegisterCodec((*url.URL).String, parseURL)
+}
+
+// formatDecimal writes r exactly as a decimal, as DecimalAttr reads it; a
+// fraction with no finite decimal, like 1/3, is an error
+func formatDecimal(r *big.Rat) (string, error) {
+	if r == nil {
+		return "", nil
+	}
+	if r.IsInt() {
+		return r.Num().String(), nil
+	}
+	d, digits := new(big.Int).Set(r.Denom()), 0
+	for _, p := range []int64{2, 5} {
+		n, div, mod := 0, big.NewInt(p), new(big.Int)
+		for {
+			q, m := new(big.Int).QuoRem(d, div, mod)
+			if m.Sign() != 0 {
+				break
+			}
+			d, n = q, n+1
+		}
+		if n > digits {
+			digits = n
+		}
+	}
+	if d.Cmp(big.NewInt(1)) != 0 {
+		return "", fmt.Errorf("%s has no finite decimal", r.RatString())
+	}
+	return r.FloatString(digits), nil
+}
+
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+var (
+	textMarshaler   = typeOf[encoding.TextMarshaler]()
+	textUnmarshaler = typeOf[encoding.TextUnmarshaler]()
+)
+
+func codecFor(t reflect.Type) (attrCodec, bool) {
+	codecMu.RLock()
+	c, ok := codecs[t]
+	codecMu.RUnlock()
+	if ok {
+		return c, true
+	}
+
+	if t.Implements(textMarshaler) && reflect.PointerTo(t).Implements(textUnmarshaler) {
+		return attrCodec{
+			format: func(v reflect.Value) (string, error) {
+				b, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+				return string(b), err
+			},
+			parse: func(s string) (reflect.Value, error) {
+				v := reflect.New(t)
+				err := v.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+				return v.Elem(), err
+			},
+		}, true
+	}
+	return kindCodec(t)
+}
+
+// kindCodec handles basic types and types defined on them, like `type ID string`
+func kindCodec(t reflect.Type) (attrCodec, bool) {
+	var c attrCodec
+	bits := 0
+	switch t.Kind() {
+	case reflect.String:
+		c.format = func(v reflect.Value) (string, error) { return v.String(), nil }
+		c.parse = func(s string) (reflect.Value, error) {
+			v := reflect.New(t).Elem()
+			v.SetString(s)
+			return v, nil
+		}
+	case reflect.Bool:
+		c.format = func(v reflect.Value) (string, error) { return strconv.FormatBool(v.Bool()), nil }
+		c.parse = func(s string) (reflect.Value, error) {
+			b, err := parseBool(s)
+			v := reflect.New(t).Elem()
+			v.SetBool(b)
+			return v, err
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		bits = t.Bits()
+		c.format = func(v reflect.Value) (string, error) { return strconv.FormatInt(v.Int(), 10), nil }
+		c.parse = func(s string) (reflect.Value, error) {
+			n, err := strconv.ParseInt(s, 10, bits)
+			v := reflect.New(t).Elem()
+			v.SetInt(n)
+			return v, err
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		bits = t.Bits()
+		c.format = func(v reflect.Value) (string, error) { return strconv.FormatUint(v.Uint(), 10), nil }
+		c.parse = func(s string) (reflect.Value, error) {
+			n, err := strconv.ParseUint(s, 10, bits)
+			v := reflect.New(t).Elem()
+			v.SetUint(n)
+			return v, err
+		}
+	case reflect.Float32, reflect.Float64:
+		bits = t.Bits()
+		c.format = func(v reflect.Value) (string, error) { return strconv.FormatFloat(v.Float(), 'f', -1, bits), nil }
+		c.parse = func(s string) (reflect.Value, error) {
+			f, err := strconv.ParseFloat(s, bits)
+			v := reflect.New(t).Elem()
+			v.SetFloat(f)
+			return v, err
+		}
+	default:
+		return c, false
+	}
+	return c, true
+}
+
+// parseValue parses val, the value of attr name if found, as a t
+func parseValue(name, val string, found bool, t reflect.Type) (reflect.Value, error) {
+	c, ok := codecFor(t)
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("No attr codec for %s", t)
+	}
+	if !found {
+		return reflect.Value{}, &AttrError{name, "", t.String(), ErrNoAttr}
+	}
+	v, err := c.parse(val)
+	if err != nil {
+		if ne, ok := err.(*strconv.NumError); ok {
+			err = ne.Err
+		}
+		return reflect.Value{}, &AttrError{name, val, t.String(), err}
+	}
+	return v, nil
+}
+
+// formatValue formats v with its codec, if it has one
+func formatValue(v reflect.Value) (string, bool, error) {
+	c, ok := codecFor(v.Type())
+	if !ok {
+		return "", false, nil
+	}
+	s, err := c.format(v)
+	return s, true, err
+}
+
+// AttrAs reads the attr name as a T with the codec of T.
+func AttrAs[T any](m Info, name string) (T, error) {
+	var ret T
+	val, found := m.AttrOk(name)
+	v, err := parseValue(name, val, found, typeOf[T]())
+	if err != nil {
+		return ret, err
+	}
+	ret, _ = v.Interface().(T)
+	return ret, nil
+}
+
+// AttrOr is like AttrAs but returns otherwise on any error.
+func AttrOr[T any](m Info, name string, otherwise T) T {
+	if ret, err := AttrAs[T](m, name); err == nil {
+		return ret
+	}
+	return otherwise
+}
+
+// WithAttrAs sets the attr name to v formatted by the codec of T; it fails
+// if T has no codec or v cannot be formatted, like a *big.Rat of 1/3.
+func WithAttrAs[T any](m Meta, name string, v T) (Meta, error) {
+	s, ok, err := formatValue(reflect.ValueOf(&v).Elem())
+	if !ok {
+		return m, fmt.Errorf("No attr codec for %s", typeOf[T]())
+	}
+	if err != nil {
+		return m, fmt.Errorf("Invalid attr %s: %v", name, err)
+	}
+	return m.WithAttr(name, s), nil
+}
+
+// WithAttrOf is WithAttrAs for types and values known to format, and panics
+// on its error.
+func WithAttrOf[T any](m Meta, name string, v T) Meta {
+	ret, err := WithAttrAs(m, name, v)
+	if err != nil {
+		panic(err.Error())
+	}
+	return ret
+}
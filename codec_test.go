@@ -0,0 +1,25 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestWithAttrAs(t *testing.T) {
+	m, err := WithAttrAs(New("Price"), "amount", big.NewRat(5, 4))
+	if err != nil || m.Attr("amount") != "1.25" {
+		t.Errorf("got %s, %v", CanonicalJson(m), err)
+	}
+	if r, err := AttrAs[*big.Rat](m, "amount"); err != nil || r.Cmp(big.NewRat(5, 4)) != 0 {
+		t.Errorf("read back %v, %v", r, err)
+	}
+
+	if _, err := WithAttrAs(New("Price"), "amount", big.NewRat(1, 3)); err == nil {
+		t.Error("1/3 formatted")
+	}
+	if _, err := WithAttrAs(New("Price"), "amount", []string{"a"}); err == nil {
+		t.Error("[]string formatted")
+	}
+}
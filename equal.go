@@ -0,0 +1,157 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"sort"
+)
+
+// Equal reports whether a and b are structurally the same, comparing kind,
+// method, ns, gid, tags, attrs, payload, subs, rels and list recursively.
+// nil and Nil are considered equal.
+func Equal(a, b Meta) bool {
+	if IsNil(a) || IsNil(b) {
+		return IsNil(a) && IsNil(b)
+	}
+	if a == b {
+		return true
+	}
+
+	if a.Kind() != b.Kind() || a.Method() != b.Method() || a.Ns() != b.Ns() ||
+		a.Gid() != b.Gid() || a.Payload() != b.Payload() || a.PayloadType() != b.PayloadType() {
+		return false
+	}
+
+	if a.TagCount() != b.TagCount() || !b.HasTags(CopyTags(a)) {
+		return false
+	}
+	if a.AttrCount() != b.AttrCount() || !b.HasAttrs(CopyAttrs(a)) {
+		return false
+	}
+
+	if a.SubCount() != b.SubCount() {
+		return false
+	}
+	names := nameSet(b.SubNames())
+	for _, name := range a.SubNames() {
+		if !names[name] || !Equal(a.Sub(name), b.Sub(name)) {
+			return false
+		}
+	}
+
+	if a.RelCount() != b.RelCount() {
+		return false
+	}
+	names = nameSet(b.RelNames())
+	for _, name := range a.RelNames() {
+		if !names[name] || !Equal(a.Rel(name), b.Rel(name)) {
+			return false
+		}
+	}
+
+	return equalList(a.List(), b.List())
+}
+
+func equalList(as, bs []Meta) bool {
+	if len(as) != len(bs) {
+		return false
+	}
+	for i := range as {
+		if !Equal(as[i], bs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func nameSet(names []string) map[string]bool {
+	ret := make(map[string]bool, len(names))
+	for _, name := range names {
+		ret[name] = true
+	}
+	return ret
+}
+
+// Hash returns the SHA-256 digest of the canonical encoding of m, so that
+// Equal metas always hash the same regardless of how they were built.
+func Hash(m Meta) [32]byte {
+	h := sha256.New()
+	writeCanonical(h, m)
+
+	var ret [32]byte
+	copy(ret[:], h.Sum(nil))
+	return ret
+}
+
+// writeCanonical writes m as length-prefixed fields with every map sorted by
+// key (names are sorted again in case m is not our own impl); Nil is written
+// as a single zero byte.
+func writeCanonical(h hash.Hash, m Meta) {
+	if IsNil(m) {
+		h.Write([]byte{0})
+		return
+	}
+	h.Write([]byte{1})
+
+	writeStr(h, m.Kind())
+	writeStr(h, m.Method())
+	writeStr(h, m.Ns())
+	writeStr(h, m.Gid())
+	writeStrMap(h, CopyTags(m))
+	writeStrMap(h, CopyAttrs(m))
+	if t := m.PayloadType(); t == "" {
+		writeStr(h, m.Payload())
+	} else { // a length no text has, keeping the hashes of text payloads
+		var buf [binary.MaxVarintLen64]byte
+		h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(m.Payload()))|1<<62)])
+		h.Write([]byte(m.Payload()))
+		writeStr(h, t)
+	}
+
+	names := sortedStrs(m.SubNames())
+	writeLen(h, len(names))
+	for _, name := range names {
+		writeStr(h, name)
+		writeCanonical(h, m.Sub(name))
+	}
+
+	names = sortedStrs(m.RelNames())
+	writeLen(h, len(names))
+	for _, name := range names {
+		writeStr(h, name)
+		writeCanonical(h, m.Rel(name))
+	}
+
+	list := m.List()
+	writeLen(h, len(list))
+	for _, item := range list {
+		writeCanonical(h, item)
+	}
+}
+
+func writeLen(h hash.Hash, n int) {
+	var buf [binary.MaxVarintLen64]byte
+	h.Write(buf[:binary.PutUvarint(buf[:], uint64(n))])
+}
+
+func writeStr(h hash.Hash, s string) {
+	writeLen(h, len(s))
+	h.Write([]byte(s))
+}
+
+func writeStrMap(h hash.Hash, vals map[string]string) {
+	keys := mapKeys(vals)
+	writeLen(h, len(keys))
+	for _, key := range keys {
+		writeStr(h, key)
+		writeStr(h, vals[key])
+	}
+}
+
+func sortedStrs(strs []string) []string {
+	sort.Strings(strs)
+	return strs
+}
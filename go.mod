@@ -2,4 +2,8 @@ module github.com/jyrobin/mp
 
 go 1.18
 
-require github.com/jyrobin/goutil v0.0.0-20220602054306-0b0b28456d12
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/jyrobin/goutil v0.0.0-20220602054306-0b0b28456d12
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -1,7 +1,12 @@
 package mp
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math/big"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -10,6 +15,12 @@ import (
 const (
 	UtcDateFormat = "2006-01-02"
 	UtcTimeFormat = "2006-01-02T15:04:05.000Z"
+
+	utcNanoFormat  = "2006-01-02T15:04:05.000000000Z"
+	utcParseFormat = "2006-01-02T15:04:05Z" // any fraction is accepted
+
+	// DefaultPayloadType is the content type of bytes payloads given none
+	DefaultPayloadType = "application/octet-stream"
 )
 
 var truth = map[string]bool{
@@ -31,7 +42,7 @@ type Info interface {
 	Tag(name string) string
 	HasTag(args ...string) bool
 	HasTags(tags map[string]string) bool
-	TagNames() []string
+	TagNames() []string // sorted
 	TagCount() int
 	TagMap() map[string]string // cloned
 	Is(kind, ns string, tags ...string) bool
@@ -40,21 +51,41 @@ type Info interface {
 	AttrOk(name string) (string, bool)
 	IntAttr(name string) (int, error)
 	IntAttrOr(name string, otherwise int) int
+	Int64Attr(name string) (int64, error)
+	Int64AttrOr(name string, otherwise int64) int64
+	Uint64Attr(name string) (uint64, error)
+	Uint64AttrOr(name string, otherwise uint64) uint64
 	BoolAttr(name string) (bool, error)
+	BoolAttrOr(name string, otherwise bool) bool
 	IsTrueAttr(name string) bool
 	IsFalseAttr(name string) bool
 	FloatAttr(name string) (float64, error)
+	FloatAttrOr(name string, otherwise float64) float64
+	DecimalAttr(name string) (*big.Rat, error)
+	DecimalAttrOr(name string, otherwise *big.Rat) *big.Rat
 	DateAttr(name string, loc ...*time.Location) (time.Time, error)
 	TimeAttr(name, layout string, loc ...*time.Location) (time.Time, error)
 	UtcAttr(name string) time.Time
+	DurationAttr(name string) (time.Duration, error)
+	DurationAttrOr(name string, otherwise time.Duration) time.Duration
+	EnumAttr(name string, values ...string) (string, error)
+	EnumAttrOr(name, otherwise string, values ...string) string
 	IntsAttr(name, sep string) ([]int, error)
+	StringsAttr(name, sep string) []string
+	MapAttr(name string) (map[string]string, error)
+	MapAttrOr(name string, otherwise map[string]string) map[string]string
+	URLAttr(name string) (*url.URL, error)
+	URLAttrOr(name string, otherwise *url.URL) *url.URL
+	JsonAttr(name string, v interface{}) error
 	HasAttr(args ...string) bool
 	HasAttrs(attrs map[string]string) bool
-	AttrNames() []string
+	AttrNames() []string // sorted
 	AttrCount() int
 	AttrMap(skips ...string) map[string]string // cloned
 
 	Payload() string
+	PayloadBytes() []byte
+	PayloadType() string
 }
 
 // base impl
@@ -64,9 +95,15 @@ type info struct {
 	mthd    string
 	ns      string
 	gid     string
-	tags    map[string]string
-	attrs   map[string]string
-	payload string
+	tags    strMap
+	attrs   strMap
+	payload payloadData
+}
+
+// payloadData is a text payload, or bytes with their content type
+type payloadData struct {
+	data  string
+	ctype string
 }
 
 func (m info) Kind() string {
@@ -102,23 +139,23 @@ func (m info) Label() string {
 //}
 
 func (m info) Tag(name string) string {
-	return m.tags[name]
+	return m.tags.At(name)
 }
 
 func (m info) HasTag(args ...string) bool {
 	return hasValue(m.tags, args)
 }
 
-func hasValue(vals map[string]string, args []string) bool {
+func hasValue(vals strMap, args []string) bool {
 	argn := len(args)
 	for i, n := 0, argn/2; i < n; i++ {
-		if val, ok := vals[args[2*i]]; !ok || val != args[2*i+1] {
+		if val, ok := vals.Get(args[2*i]); !ok || val != args[2*i+1] {
 			return false
 		}
 	}
 	ok := true
 	if argn%2 != 0 {
-		_, ok = vals[args[argn-1]]
+		ok = vals.Has(args[argn-1])
 	}
 	return ok
 }
@@ -127,9 +164,9 @@ func (m info) HasTags(ts map[string]string) bool {
 	return hasValues(m.tags, ts)
 }
 
-func hasValues(vals, ts map[string]string) bool {
+func hasValues(vals strMap, ts map[string]string) bool {
 	for k, v := range ts {
-		if val, ok := vals[k]; !ok || val != v {
+		if val, ok := vals.Get(k); !ok || val != v {
 			return false
 		}
 	}
@@ -137,35 +174,25 @@ func hasValues(vals, ts map[string]string) bool {
 }
 
 func (m info) TagCount() int {
-	return len(m.tags)
+	return m.tags.Len()
 }
 
 func (m info) TagNames() []string {
-	return mapKeys(m.tags)
+	return m.tags.Keys()
 }
 
+// mapKeys returns the keys sorted, so that iteration order is deterministic
 func mapKeys(v map[string]string) []string {
 	keys := make([]string, 0, len(v))
-	for key, _ := range v {
+	for key := range v {
 		keys = append(keys, key)
 	}
+	sort.Strings(keys)
 	return keys
 }
 
-func copyStrMap(src map[string]string, more int) map[string]string {
-	ret := make(map[string]string, len(src)+more)
-	for k, v := range src {
-		ret[k] = v
-	}
-	return ret
-}
-
 func (m info) TagMap() map[string]string {
-	ret := make(map[string]string, len(m.tags))
-	for k, v := range m.tags {
-		ret[k] = v
-	}
-	return ret
+	return m.tags.Map()
 }
 
 func (m info) Is(kind, ns string, tags ...string) bool {
@@ -173,7 +200,7 @@ func (m info) Is(kind, ns string, tags ...string) bool {
 }
 
 func (m info) Attr(name string, otherwise ...string) string {
-	if ret, ok := m.attrs[name]; ok {
+	if ret, ok := m.attrs.Get(name); ok {
 		return ret
 	}
 	if len(otherwise) > 0 {
@@ -182,28 +209,96 @@ func (m info) Attr(name string, otherwise ...string) string {
 	return ""
 }
 func (m info) AttrOk(name string) (string, bool) {
-	ret, ok := m.attrs[name]
-	return ret, ok
+	return m.attrs.Get(name)
 }
 
-func (m info) IntAttr(name string) (int, error) {
-	return strconv.Atoi(m.attrs[name])
+// AttrError reports an attr value that cannot be read as Type; Err is the
+// underlying parse error, or ErrNoAttr if the attr is missing.
+type AttrError struct {
+	Name  string
+	Value string
+	Type  string
+	Err   error
 }
-func (m info) IntAttrOr(name string, otherwise int) int {
-	if val, ok := m.attrs[name]; ok {
-		if ret, err := strconv.Atoi(val); err == nil {
+
+var ErrNoAttr = errors.New("missing attr")
+
+func (e *AttrError) Error() string {
+	if e.Err == ErrNoAttr {
+		return fmt.Sprintf("Missing %s attr %s", e.Type, e.Name)
+	}
+	return fmt.Sprintf("Invalid %s attr %s=%q: %v", e.Type, e.Name, e.Value, e.Err)
+}
+
+func (e *AttrError) Unwrap() error {
+	return e.Err
+}
+
+// parseAttr looks name up and parses it, wrapping any failure in AttrError
+func parseAttr[T any](m info, name, typ string, parse func(string) (T, error)) (T, error) {
+	val, ok := m.attrs.Get(name)
+	if !ok {
+		var zero T
+		return zero, &AttrError{name, "", typ, ErrNoAttr}
+	}
+	ret, err := parse(val)
+	if err != nil {
+		if ne, ok := err.(*strconv.NumError); ok {
+			err = ne.Err // the value is in AttrError already
+		}
+		return ret, &AttrError{name, val, typ, err}
+	}
+	return ret, nil
+}
+
+// orAttr returns otherwise when parseAttr fails
+func orAttr[T any](m info, name string, otherwise T, parse func(string) (T, error)) T {
+	if val, ok := m.attrs.Get(name); ok {
+		if ret, err := parse(val); err == nil {
 			return ret
 		}
 	}
 	return otherwise
 }
 
-func (m info) BoolAttr(name string) (bool, error) {
-	val := m.Attr(name)
+func (m info) IntAttr(name string) (int, error) {
+	return parseAttr(m, name, "int", strconv.Atoi)
+}
+func (m info) IntAttrOr(name string, otherwise int) int {
+	return orAttr(m, name, otherwise, strconv.Atoi)
+}
+
+func parseInt64(val string) (int64, error) {
+	return strconv.ParseInt(val, 10, 64)
+}
+func (m info) Int64Attr(name string) (int64, error) {
+	return parseAttr(m, name, "int64", parseInt64)
+}
+func (m info) Int64AttrOr(name string, otherwise int64) int64 {
+	return orAttr(m, name, otherwise, parseInt64)
+}
+
+func parseUint64(val string) (uint64, error) {
+	return strconv.ParseUint(val, 10, 64)
+}
+func (m info) Uint64Attr(name string) (uint64, error) {
+	return parseAttr(m, name, "uint64", parseUint64)
+}
+func (m info) Uint64AttrOr(name string, otherwise uint64) uint64 {
+	return orAttr(m, name, otherwise, parseUint64)
+}
+
+func parseBool(val string) (bool, error) {
 	if b, ok := truth[strings.ToLower(val)]; ok {
 		return b, nil
 	}
-	return false, fmt.Errorf("Invalid bool %s", val)
+	return false, errors.New("not a bool")
+}
+func (m info) BoolAttr(name string) (bool, error) {
+	return parseAttr(m, name, "bool", parseBool)
+}
+func (m info) BoolAttrOr(name string, otherwise bool) bool {
+	return orAttr(m, name, otherwise, parseBool)
 }
 func (m info) IsTrueAttr(name string) bool {
 	val := strings.ToLower(m.Attr(name))
@@ -216,44 +311,179 @@ func (m info) IsFalseAttr(name string) bool {
 	return ok && !b
 }
 
+func parseFloat(val string) (float64, error) {
+	return strconv.ParseFloat(val, 64)
+}
 func (m info) FloatAttr(name string) (float64, error) {
-	return strconv.ParseFloat(m.attrs[name], 64)
+	return parseAttr(m, name, "float", parseFloat)
 }
-func (m info) DateAttr(name string, loc ...*time.Location) (time.Time, error) {
-	if len(loc) > 0 && loc[0] != nil {
-		return time.ParseInLocation(UtcDateFormat, m.attrs[name], loc[0])
+func (m info) FloatAttrOr(name string, otherwise float64) float64 {
+	return orAttr(m, name, otherwise, parseFloat)
+}
+
+// parseDecimal reads an exact decimal such as "12.30" or "-1e3"; fractions
+// like "1/3" are not accepted
+func parseDecimal(val string) (*big.Rat, error) {
+	if strings.Contains(val, "/") {
+		return nil, errors.New("not a decimal")
 	}
-	return time.Parse(UtcDateFormat, m.attrs[name]) // UTC
+	if r, ok := new(big.Rat).SetString(val); ok {
+		return r, nil
+	}
+	return nil, errors.New("not a decimal")
+}
+
+// DecimalAttr reads the attr exactly, e.g. for prices.
+func (m info) DecimalAttr(name string) (*big.Rat, error) {
+	return parseAttr(m, name, "decimal", parseDecimal)
+}
+func (m info) DecimalAttrOr(name string, otherwise *big.Rat) *big.Rat {
+	return orAttr(m, name, otherwise, parseDecimal)
+}
+
+func (m info) DateAttr(name string, loc ...*time.Location) (time.Time, error) {
+	return m.timeAttr(name, "date", UtcDateFormat, loc) // UTC by default
 }
 func (m info) TimeAttr(name, layout string, loc ...*time.Location) (time.Time, error) {
-	if len(loc) > 0 && loc[0] != nil {
-		return time.ParseInLocation(layout, m.attrs[name], loc[0])
-	}
-	return time.Parse(layout, m.attrs[name])
+	return m.timeAttr(name, "time", layout, loc)
+}
+func (m info) timeAttr(name, typ, layout string, loc []*time.Location) (time.Time, error) {
+	return parseAttr(m, name, typ, func(val string) (time.Time, error) {
+		if len(loc) > 0 && loc[0] != nil {
+			return time.ParseInLocation(layout, val, loc[0])
+		}
+		return time.Parse(layout, val)
+	})
 }
 func (m info) UtcAttr(name string) time.Time {
-	if ret, err := time.Parse(UtcTimeFormat, m.attrs[name]); err == nil {
+	if ret, err := parseUtc(m.attrs.At(name)); err == nil {
 		return ret
 	}
 	return time.Time{}
 }
 
+// formatUtc writes t in UtcTimeFormat, or with nanoseconds if t has a
+// fraction of a millisecond, so that parseUtc reads t back exactly
+func formatUtc(t time.Time) string {
+	if t.Nanosecond()%int(time.Millisecond) != 0 {
+		return t.UTC().Format(utcNanoFormat)
+	}
+	return t.UTC().Format(UtcTimeFormat)
+}
+
+// parseUtc reads UtcTimeFormat with any fraction of a second, or none
+func parseUtc(val string) (time.Time, error) {
+	return time.Parse(utcParseFormat, val)
+}
+
+func (m info) DurationAttr(name string) (time.Duration, error) {
+	return parseAttr(m, name, "duration", time.ParseDuration)
+}
+func (m info) DurationAttrOr(name string, otherwise time.Duration) time.Duration {
+	return orAttr(m, name, otherwise, time.ParseDuration)
+}
+
+func parseEnum(values []string) func(string) (string, error) {
+	return func(val string) (string, error) {
+		if contains(values, val) {
+			return val, nil
+		}
+		return "", fmt.Errorf("not one of %s", strings.Join(values, ", "))
+	}
+}
+
+// EnumAttr returns the attr if it is one of values.
+func (m info) EnumAttr(name string, values ...string) (string, error) {
+	return parseAttr(m, name, "enum", parseEnum(values))
+}
+func (m info) EnumAttrOr(name, otherwise string, values ...string) string {
+	return orAttr(m, name, otherwise, parseEnum(values))
+}
+
 func (m info) IntsAttr(name, sep string) ([]int, error) {
-	v := m.attrs[name]
+	v := m.attrs.At(name)
 	if v == "" {
 		return []int{}, nil
 	}
 	words := strings.Split(v, sep)
 	ret := make([]int, len(words))
-	var err error
 	for i, word := range words {
-		if ret[i], err = strconv.Atoi(word); err != nil {
-			return nil, err
+		n, err := strconv.Atoi(word)
+		if err != nil {
+			return nil, &AttrError{name, v, "ints", fmt.Errorf("item %d %q is not an int", i, word)}
 		}
+		ret[i] = n
 	}
 	return ret, nil
 }
 
+// StringsAttr splits the attr by sep, trimming spaces; empty means none.
+func (m info) StringsAttr(name, sep string) []string {
+	v := m.attrs.At(name)
+	if v == "" {
+		return []string{}
+	}
+	words := strings.Split(v, sep)
+	for i, word := range words {
+		words[i] = strings.TrimSpace(word)
+	}
+	return words
+}
+
+// parseMap reads "k=v;k2=v2", trimming spaces around keys and values
+func parseMap(val string) (map[string]string, error) {
+	ret := map[string]string{}
+	for i, item := range strings.Split(val, ";") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(item, "=")
+		if k = strings.TrimSpace(k); !ok || k == "" {
+			return nil, fmt.Errorf("item %d %q is not k=v", i, item)
+		}
+		ret[k] = strings.TrimSpace(v)
+	}
+	return ret, nil
+}
+
+// MapAttr reads an attr like "k=v;k2=v2".
+func (m info) MapAttr(name string) (map[string]string, error) {
+	return parseAttr(m, name, "map", parseMap)
+}
+func (m info) MapAttrOr(name string, otherwise map[string]string) map[string]string {
+	return orAttr(m, name, otherwise, parseMap)
+}
+
+// parseURL accepts absolute URLs only, as url.Parse takes almost anything
+func parseURL(val string) (*url.URL, error) {
+	u, err := url.Parse(val)
+	if err != nil {
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		return nil, err
+	}
+	if !u.IsAbs() {
+		return nil, errors.New("not an absolute URL")
+	}
+	return u, nil
+}
+
+func (m info) URLAttr(name string) (*url.URL, error) {
+	return parseAttr(m, name, "URL", parseURL)
+}
+func (m info) URLAttrOr(name string, otherwise *url.URL) *url.URL {
+	return orAttr(m, name, otherwise, parseURL)
+}
+
+// JsonAttr unmarshals the attr into v.
+func (m info) JsonAttr(name string, v interface{}) error {
+	_, err := parseAttr(m, name, "JSON", func(val string) (struct{}, error) {
+		return struct{}{}, json.Unmarshal([]byte(val), v)
+	})
+	return err
+}
+
 func (m info) HasAttr(args ...string) bool {
 	return hasValue(m.attrs, args)
 }
@@ -263,21 +493,22 @@ func (m info) HasAttrs(ts map[string]string) bool {
 }
 
 func (m info) AttrCount() int {
-	return len(m.attrs)
+	return m.attrs.Len()
 }
 
 func (m info) AttrNames() []string {
-	return mapKeys(m.attrs)
+	return m.attrs.Keys()
 }
 
 func (m info) AttrMap(skips ...string) map[string]string {
 	b := len(skips) == 0
-	ret := make(map[string]string, len(m.attrs))
-	for k, v := range m.attrs {
+	ret := make(map[string]string, m.attrs.Len())
+	m.attrs.Range(func(k, v string) bool {
 		if b || !contains(skips, k) {
 			ret[k] = v
 		}
-	}
+		return true
+	})
 	return ret
 }
 
@@ -292,8 +523,21 @@ func contains(arr []string, val string) bool {
 
 // payload
 
+// Payload returns the payload, the bytes as a string if it has a type.
 func (m info) Payload() string {
-	return m.payload
+	return m.payload.data
+}
+
+func (m info) PayloadBytes() []byte {
+	if m.payload.data == "" {
+		return nil
+	}
+	return []byte(m.payload.data)
+}
+
+// PayloadType returns the content type of a bytes payload, or "" for text.
+func (m info) PayloadType() string {
+	return m.payload.ctype
 }
 
 // utils
@@ -2,20 +2,31 @@
 package mp
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
 )
 
+// CanonicalOpt passed to Json selects the canonical encoding
+const CanonicalOpt = "canonical"
+
 type MetaJson struct {
-	Kind    string              `json:"kind,omitempty"`
-	Method  string              `json:"method,omitempty"`
-	Ns      string              `json:"ns,omitempty"`
-	Gid     string              `json:"gid,omitempty"`
-	Tags    map[string]string   `json:"tags,omitempty"`
-	Attrs   map[string]string   `json:"attrs,omitempty"`
-	Payload string              `json:"payload,omitempty"`
-	Subs    map[string]MetaJson `json:"subs,omitempty"`
-	Rels    map[string]MetaJson `json:"rels,omitempty"`
-	List    []MetaJson          `json:"list,omitempty"`
+	Kind    string            `json:"kind,omitempty"`
+	Method  string            `json:"method,omitempty"`
+	Ns      string            `json:"ns,omitempty"`
+	Gid     string            `json:"gid,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+	Payload string            `json:"payload,omitempty"`
+	// PayloadType is the content type of a bytes payload, in base64 as
+	// PayloadEncoding says.
+	PayloadType     string              `json:"payloadType,omitempty"`
+	PayloadEncoding string              `json:"payloadEncoding,omitempty"`
+	Subs            map[string]MetaJson `json:"subs,omitempty"`
+	Rels            map[string]MetaJson `json:"rels,omitempty"`
+	List            []MetaJson          `json:"list,omitempty"`
 }
 
 func ParseMeta(buf []byte) (Meta, error) {
@@ -23,34 +34,103 @@ func ParseMeta(buf []byte) (Meta, error) {
 	if err := json.Unmarshal(buf, &mj); err != nil {
 		return Nil, err
 	}
+	if err := mj.checkPayloads(); err != nil {
+		return Nil, err
+	}
 	return JsonToMeta(mj), nil
 }
 
-/*func ParseMetas(buf []byte) ([]Meta, error) {
-	var mjs []MetaJson
-	if err := json.Unmarshal(buf, &mjs); err != nil {
-		return nil, err
+const payloadBase64 = "base64"
+
+// encodePayload returns the payload, its type and encoding as in MetaJson
+func encodePayload(m Info) (data, ctype, enc string) {
+	return encodePayloadData(m.Payload(), m.PayloadType())
+}
+
+func encodePayloadData(data, ctype string) (string, string, string) {
+	if ctype == "" {
+		return data, "", ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(data)), ctype, payloadBase64
+}
+
+// decodePayload reverses encodePayload; a type without encoding is taken
+// as bytes as they are, and an encoding without type as DefaultPayloadType.
+func decodePayload(data, ctype, enc string) (payloadData, error) {
+	switch enc {
+	case "":
+	case payloadBase64:
+		buf, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return payloadData{}, fmt.Errorf("bad base64: %v", err)
+		}
+		data = string(buf)
+		if ctype == "" {
+			ctype = DefaultPayloadType
+		}
+	default:
+		return payloadData{}, fmt.Errorf("unknown encoding %s", enc)
+	}
+	if data == "" {
+		return payloadData{}, nil
+	}
+	return payloadData{data, ctype}, nil
+}
+
+// checkPayloads reports the first payload JsonToMeta cannot decode
+func (mj MetaJson) checkPayloads() error {
+	if _, err := decodePayload(mj.Payload, mj.PayloadType, mj.PayloadEncoding); err != nil {
+		return fmt.Errorf("Invalid payload: %v", err)
+	}
+	for _, sub := range mj.Subs {
+		if err := sub.checkPayloads(); err != nil {
+			return err
+		}
 	}
-	return JsonsToMetas(mjs), nil
+	for _, rel := range mj.Rels {
+		if err := rel.checkPayloads(); err != nil {
+			return err
+		}
+	}
+	for _, item := range mj.List {
+		if err := item.checkPayloads(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
-*/
 
+// MetaToJson converts m; a node that contains itself (possible only with
+// other Meta impls) is written as a Ref the second time.
 func MetaToJson(m Meta) MetaJson {
+	return metaToJson(m, map[Meta]bool{})
+}
+
+// metaToJson tracks the nodes on the current path in stack
+func metaToJson(m Meta, stack map[Meta]bool) MetaJson {
 	if m == nil || m.IsNil() {
 		return MetaJson{}
 	}
+	if stack[m] {
+		return metaToJson(Ref(m), stack)
+	}
+	stack[m] = true
+	defer delete(stack, m)
 
+	payload, ctype, enc := encodePayload(m)
 	return MetaJson{
-		Kind:    m.Kind(),
-		Method:  m.Method(),
-		Ns:      m.Ns(),
-		Gid:     m.Gid(),
-		Tags:    CopyTags(m),
-		Attrs:   CopyAttrs(m),
-		Payload: m.Payload(),
-		Subs:    subMetaJsons(m),
-		Rels:    relMetaJsons(m),
-		List:    listMetaJsons(m),
+		Kind:            m.Kind(),
+		Method:          m.Method(),
+		Ns:              m.Ns(),
+		Gid:             m.Gid(),
+		Tags:            CopyTags(m),
+		Attrs:           CopyAttrs(m),
+		Payload:         payload,
+		PayloadType:     ctype,
+		PayloadEncoding: enc,
+		Subs:            subMetaJsons(m, stack),
+		Rels:            relMetaJsons(m, stack),
+		List:            listMetaJsons(m, stack),
 	}
 }
 
@@ -62,51 +142,61 @@ func MetasToJsons(ms []Meta) []MetaJson {
 	return items
 }
 
-func subMetaJsons(m Meta) map[string]MetaJson {
+func subMetaJsons(m Meta, stack map[Meta]bool) map[string]MetaJson {
 	ret := make(map[string]MetaJson, m.SubCount())
 	for _, name := range m.SubNames() {
-		ret[name] = MetaToJson(m.Sub(name))
+		ret[name] = metaToJson(m.Sub(name), stack)
 	}
 	return ret
 }
 
-func relMetaJsons(m Meta) map[string]MetaJson {
+func relMetaJsons(m Meta, stack map[Meta]bool) map[string]MetaJson {
 	ret := make(map[string]MetaJson, m.RelCount())
 	for _, name := range m.RelNames() {
-		ret[name] = MetaToJson(m.Rel(name))
+		ret[name] = metaToJson(m.Rel(name), stack)
 	}
 	return ret
 }
 
-func listMetaJsons(m Meta) []MetaJson {
+func listMetaJsons(m Meta, stack map[Meta]bool) []MetaJson {
 	items := m.List()
 	ret := make([]MetaJson, len(items))
 	for idx, item := range items {
-		ret[idx] = MetaToJson(item)
+		ret[idx] = metaToJson(item, stack)
 	}
 	return ret
 }
 
+// JsonToMeta converts mj, taking a payload that cannot be decoded as plain
+// text, without its type.
 func JsonToMeta(mj MetaJson) Meta {
 	if mj.IsNil() {
 		return Nil
 	}
+	return jsonBuilder(mj).Build()
+}
 
-	ret := New(mj.Kind, mj.Method, mj.Ns, mj.Gid).
-		WithTags(mj.Tags).
-		WithAttrs(mj.Attrs).
-		WithPayload(mj.Payload)
+func jsonBuilder(mj MetaJson) *Builder {
+	b := NewBuilder(mj.Kind, mj.Method, mj.Ns, mj.Gid).
+		SetTags(mj.Tags).
+		SetAttrs(mj.Attrs)
+	if payload, err := decodePayload(mj.Payload, mj.PayloadType, mj.PayloadEncoding); err == nil {
+		b.payload = payload
+	} else { // text as written, where ParseMeta fails
+		b.payload = payloadData{data: mj.Payload}
+	}
 	for name, subJson := range mj.Subs {
-		ret = ret.WithSub(name, JsonToMeta(subJson))
+		b.SetSub(name, JsonToMeta(subJson))
 	}
 	for name, relJson := range mj.Rels {
-		ret = ret.WithRel(name, JsonToMeta(relJson))
+		b.SetRel(name, JsonToMeta(relJson))
 	}
-	if len(mj.List) > 0 {
-		ret = ret.WithList(JsonsToMetas(mj.List))
+	for _, item := range mj.List {
+		if !item.IsNil() { // as WithList trims
+			b.AppendList(JsonToMeta(item))
+		}
 	}
-
-	return ret
+	return b
 }
 
 func JsonsToMetas(ml []MetaJson) []Meta {
@@ -130,6 +220,10 @@ func (mj MetaJson) String() string {
 	return mj.Json("  ")
 }
 func (mj MetaJson) Json(opts ...string) string {
+	if len(opts) == 1 && opts[0] == CanonicalOpt {
+		return mj.CanonicalJson()
+	}
+
 	var buf []byte
 	switch len(opts) {
 	case 0:
@@ -142,6 +236,163 @@ func (mj MetaJson) Json(opts ...string) string {
 	return string(buf)
 }
 
+// canonical
+
+// CanonicalJson returns m as JSON with all keys sorted, no insignificant
+// whitespace and no HTML escaping, fit for signing and hashing.
+func CanonicalJson(m Meta) string {
+	return MetaToJson(m).CanonicalJson()
+}
+
+func (mj MetaJson) CanonicalJson() string {
+	var sb strings.Builder
+	mj.writeCanonical(&sb)
+	return sb.String()
+}
+
+// writeCanonical writes the non-empty fields in key order
+func (mj MetaJson) writeCanonical(sb *strings.Builder) {
+	sb.WriteByte('{')
+	sep := false
+	key := func(name string) {
+		if sep {
+			sb.WriteByte(',')
+		}
+		sep = true
+		writeJsonStr(sb, name)
+		sb.WriteByte(':')
+	}
+
+	if len(mj.Attrs) > 0 {
+		key("attrs")
+		writeCanonicalStrs(sb, mj.Attrs)
+	}
+	if mj.Gid != "" {
+		key("gid")
+		writeJsonStr(sb, mj.Gid)
+	}
+	if mj.Kind != "" {
+		key("kind")
+		writeJsonStr(sb, mj.Kind)
+	}
+	if len(mj.List) > 0 {
+		key("list")
+		sb.WriteByte('[')
+		for i, item := range mj.List {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			item.writeCanonical(sb)
+		}
+		sb.WriteByte(']')
+	}
+	if mj.Method != "" {
+		key("method")
+		writeJsonStr(sb, mj.Method)
+	}
+	if mj.Ns != "" {
+		key("ns")
+		writeJsonStr(sb, mj.Ns)
+	}
+	if mj.Payload != "" {
+		key("payload")
+		writeJsonStr(sb, mj.Payload)
+	}
+	if mj.PayloadEncoding != "" {
+		key("payloadEncoding")
+		writeJsonStr(sb, mj.PayloadEncoding)
+	}
+	if mj.PayloadType != "" {
+		key("payloadType")
+		writeJsonStr(sb, mj.PayloadType)
+	}
+	if len(mj.Rels) > 0 {
+		key("rels")
+		writeCanonicalJsons(sb, mj.Rels)
+	}
+	if len(mj.Subs) > 0 {
+		key("subs")
+		writeCanonicalJsons(sb, mj.Subs)
+	}
+	if len(mj.Tags) > 0 {
+		key("tags")
+		writeCanonicalStrs(sb, mj.Tags)
+	}
+	sb.WriteByte('}')
+}
+
+func writeCanonicalStrs(sb *strings.Builder, vals map[string]string) {
+	sb.WriteByte('{')
+	for i, k := range mapKeys(vals) {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		writeJsonStr(sb, k)
+		sb.WriteByte(':')
+		writeJsonStr(sb, vals[k])
+	}
+	sb.WriteByte('}')
+}
+
+func writeCanonicalJsons(sb *strings.Builder, mjs map[string]MetaJson) {
+	keys := make([]string, 0, len(mjs))
+	for k := range mjs {
+		keys = append(keys, k)
+	}
+	sb.WriteByte('{')
+	for i, k := range sortedStrs(keys) {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		writeJsonStr(sb, k)
+		sb.WriteByte(':')
+		mjs[k].writeCanonical(sb)
+	}
+	sb.WriteByte('}')
+}
+
+// writeJsonStr escapes only what JSON requires; invalid UTF-8 becomes U+FFFD
+func writeJsonStr(sb *strings.Builder, s string) {
+	const hex = "0123456789abcdef"
+	sb.WriteByte('"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				sb.WriteByte('\\')
+				sb.WriteByte(c)
+			case c == '\n':
+				sb.WriteString(`\n`)
+			case c == '\r':
+				sb.WriteString(`\r`)
+			case c == '\t':
+				sb.WriteString(`\t`)
+			case c == '\b':
+				sb.WriteString(`\b`)
+			case c == '\f':
+				sb.WriteString(`\f`)
+			case c < 0x20:
+				sb.WriteString(`\u00`)
+				sb.WriteByte(hex[c>>4])
+				sb.WriteByte(hex[c&0xf])
+			default:
+				sb.WriteByte(c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			sb.WriteString("\ufffd")
+		} else {
+			sb.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	sb.WriteByte('"')
+}
+
 // MetaListJson
 
 type MetaListJson struct {
@@ -0,0 +1,25 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"testing"
+)
+
+func TestJsonToMetaPayload(t *testing.T) {
+	for _, c := range []struct {
+		mj          MetaJson
+		data, ctype string
+	}{
+		{MetaJson{Kind: "A", Payload: "AAE=", PayloadType: "image/png", PayloadEncoding: "base64"}, "\x00\x01", "image/png"},
+		{MetaJson{Kind: "A", Payload: "AAE=", PayloadEncoding: "base64"}, "\x00\x01", DefaultPayloadType},
+		{MetaJson{Kind: "A", Payload: "text"}, "text", ""},
+		{MetaJson{Kind: "A", Payload: "not base64!", PayloadType: "image/png", PayloadEncoding: "base64"}, "not base64!", ""},
+		{MetaJson{Kind: "A", Payload: "AAE=", PayloadType: "image/png", PayloadEncoding: "hex"}, "AAE=", ""},
+	} {
+		m := JsonToMeta(c.mj)
+		if string(m.PayloadBytes()) != c.data || m.PayloadType() != c.ctype {
+			t.Errorf("%+v: got %q of %q", c.mj, m.PayloadBytes(), m.PayloadType())
+		}
+	}
+}
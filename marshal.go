@@ -0,0 +1,530 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Marshal and Unmarshal map structs to Metas by field tags of the form
+//
+//	`mp:"name,role,omitempty,kind=Kind,ns=ns"`
+//
+// where role is one of
+//
+//	attr, tag      a value with an attr codec (see RegisterCodec)
+//	attrs, tags    a map[string]string of all the other attrs or tags
+//	payload        a string, or a []byte as a bytes payload of
+//	               DefaultPayloadType
+//	sub, rel       a struct, pointer to struct, or Meta
+//	list           a slice of those, at most one per struct
+//	kind, ns, gid, method
+//	               a string holding that part of the Meta
+//
+// The name defaults to the field name, and the role to attr for types with a
+// codec, payload for []byte, sub for structs and list for slices. kind= and
+// ns= give the kind and ns of subs, rels and list items. The kind of a struct
+// is, in order, the value of its kind field, kind= of the parent field, kind=
+// of a blank field `_ struct{} mp:",kind=Kind,ns=ns"`, or else the type name;
+// when the latter two are set, Unmarshal checks it, and Marshal fails if none
+// is. Fields tagged "-", unexported fields and untagged fields of types no
+// role takes are skipped. Embedded structs and pointers to structs are
+// flattened; Marshal skips the fields of nil pointers and Unmarshal allocates
+// them. time.Time goes through its codec, i.e. UtcTimeFormat as WithUtcAttr
+// writes it.
+
+const (
+	roleAttr    = "attr"
+	roleTag     = "tag"
+	roleAttrs   = "attrs"
+	roleTags    = "tags"
+	rolePayload = "payload"
+	roleSub     = "sub"
+	roleRel     = "rel"
+	roleList    = "list"
+	roleKind    = "kind"
+	roleNs      = "ns"
+	roleGid     = "gid"
+	roleMethod  = "method"
+)
+
+// FieldError reports the struct field, like "Items[2].Price", that failed
+// to marshal or unmarshal.
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("Field %s: %v", e.Field, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// fieldErr prefixes the field path of err with field
+func fieldErr(field string, err error) error {
+	if fe, ok := err.(*FieldError); ok {
+		sep := "."
+		if strings.HasPrefix(fe.Field, "[") {
+			sep = ""
+		}
+		return &FieldError{field + sep + fe.Field, fe.Err}
+	}
+	return &FieldError{field, err}
+}
+
+type mpField struct {
+	index     []int
+	goName    string
+	name      string
+	role      string
+	omitEmpty bool
+	kind, ns  string
+}
+
+type mpStruct struct {
+	kind, ns string // from the blank field
+	fields   []mpField
+}
+
+var mpStructs sync.Map // reflect.Type -> *mpStruct
+
+func mpStructOf(t reflect.Type) (*mpStruct, error) {
+	if s, ok := mpStructs.Load(t); ok {
+		return s.(*mpStruct), nil
+	}
+	s := &mpStruct{}
+	if err := s.addFields(t, nil, map[reflect.Type]bool{t: true}); err != nil {
+		return nil, err
+	}
+	lists := 0
+	for _, f := range s.fields {
+		if f.role == roleList {
+			lists++
+		}
+	}
+	if lists > 1 {
+		return nil, fmt.Errorf("Struct %s has %d list fields", t, lists)
+	}
+	mpStructs.Store(t, s)
+	return s, nil
+}
+
+// addFields adds the fields of t, flattening embedded structs not already in
+// embedded
+func (s *mpStruct) addFields(t reflect.Type, index []int, embedded map[reflect.Type]bool) error {
+	for i, n := 0, t.NumField(); i < n; i++ {
+		sf := t.Field(i)
+		tag, tagged := sf.Tag.Lookup("mp")
+		if tag == "-" {
+			continue
+		}
+		idx := append(append([]int{}, index...), i)
+
+		name, opts, _ := strings.Cut(tag, ",")
+		f := mpField{index: idx, goName: sf.Name, name: name}
+		for _, opt := range strings.Split(opts, ",") {
+			switch {
+			case opt == "":
+			case opt == "omitempty":
+				f.omitEmpty = true
+			case strings.HasPrefix(opt, "kind="):
+				f.kind = opt[len("kind="):]
+			case strings.HasPrefix(opt, "ns="):
+				f.ns = opt[len("ns="):]
+			default:
+				f.role = opt
+			}
+		}
+
+		if sf.Name == "_" {
+			s.kind, s.ns = f.kind, f.ns
+			continue
+		}
+		if et := sf.Type; sf.Anonymous && !tagged {
+			if et.Kind() == reflect.Pointer {
+				if !sf.IsExported() { // cannot be allocated
+					continue
+				}
+				et = et.Elem()
+			}
+			if et.Kind() == reflect.Struct {
+				if embedded[et] {
+					continue
+				}
+				embedded[et] = true
+				err := s.addFields(et, idx, embedded)
+				delete(embedded, et)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if !sf.IsExported() {
+			continue
+		}
+
+		if f.name == "" {
+			f.name = sf.Name
+		}
+		if f.role == "" {
+			f.role = defaultRole(sf.Type)
+		}
+		if err := checkRole(f.role, sf.Type); err != nil {
+			if !tagged {
+				continue
+			}
+			return fmt.Errorf("Field %s.%s: %v", t, sf.Name, err)
+		}
+		s.fields = append(s.fields, f)
+	}
+	return nil
+}
+
+func defaultRole(t reflect.Type) string {
+	if hasCodec(t) {
+		return roleAttr
+	}
+	if t == bytesType {
+		return rolePayload
+	}
+	if t.Kind() == reflect.Slice {
+		return roleList
+	}
+	return roleSub
+}
+
+func checkRole(role string, t reflect.Type) error {
+	ok := false
+	switch role {
+	case roleAttr, roleTag:
+		ok = hasCodec(t)
+	case roleAttrs, roleTags:
+		ok = t == reflect.TypeOf(map[string]string{})
+	case rolePayload:
+		ok = t.Kind() == reflect.String || t == bytesType
+	case roleKind, roleNs, roleGid, roleMethod:
+		ok = t.Kind() == reflect.String
+	case roleSub, roleRel:
+		ok = isNode(t)
+	case roleList:
+		ok = t.Kind() == reflect.Slice && isNode(t.Elem())
+	default:
+		return fmt.Errorf("Unknown role %s", role)
+	}
+	if !ok {
+		return fmt.Errorf("Type %s cannot be %s", t, role)
+	}
+	return nil
+}
+
+var bytesType = reflect.TypeOf([]byte{})
+
+// hasCodec also accepts pointers to types with codecs, nil meaning absent
+func hasCodec(t reflect.Type) bool {
+	if _, ok := codecFor(t); ok {
+		return true
+	}
+	if t.Kind() == reflect.Pointer {
+		_, ok := codecFor(t.Elem())
+		return ok
+	}
+	return false
+}
+
+// isNode tells if t maps to a Meta
+func isNode(t reflect.Type) bool {
+	if t == metaType {
+		return true
+	}
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct
+}
+
+// Marshal converts the struct v, or pointer to one, to a Meta.
+func Marshal(v interface{}) (Meta, error) {
+	if m, ok := v.(Meta); ok {
+		return orNil(m), nil
+	}
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return Nil, fmt.Errorf("Cannot marshal %T", v)
+	}
+	return marshalStruct(rv, "", "")
+}
+
+func marshalStruct(v reflect.Value, kind, ns string) (Meta, error) {
+	t := v.Type()
+	s, err := mpStructOf(t)
+	if err != nil {
+		return Nil, err
+	}
+	b := &Builder{kind: t.Name()}
+	if kind == "" {
+		kind = s.kind
+	}
+	if ns == "" {
+		ns = s.ns
+	}
+	if kind != "" {
+		b.kind = kind
+	}
+	b.ns = ns
+
+	for _, f := range s.fields {
+		fv, err := v.FieldByIndexErr(f.index)
+		if err != nil { // in a nil embedded pointer
+			continue
+		}
+		if f.omitEmpty && (fv.IsZero() || fv.Kind() == reflect.Slice && fv.Len() == 0) {
+			continue
+		}
+		if err := marshalField(b, f, fv); err != nil {
+			return Nil, fieldErr(f.goName, err)
+		}
+	}
+	if b.kind == "" {
+		return Nil, fmt.Errorf("No kind for %s", t)
+	}
+	return b.Build(), nil
+}
+
+func marshalField(b *Builder, f mpField, fv reflect.Value) error {
+	switch f.role {
+	case roleKind:
+		if fv.String() != "" {
+			b.kind = fv.String()
+		}
+	case roleNs:
+		if fv.String() != "" {
+			b.ns = fv.String()
+		}
+	case roleGid:
+		b.gid = fv.String()
+	case roleMethod:
+		b.mthd = fv.String()
+	case rolePayload:
+		if fv.Type() == bytesType {
+			b.SetBytesPayload(fv.Bytes(), DefaultPayloadType)
+		} else {
+			b.SetPayload(fv.String())
+		}
+	case roleAttr, roleTag:
+		if fv.Kind() == reflect.Pointer && fv.IsNil() {
+			return nil
+		}
+		s, ok, err := formatValue(fv)
+		if !ok {
+			s, _, err = formatValue(fv.Elem())
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid %s %s: %v", f.role, f.name, err)
+		}
+		if f.role == roleAttr {
+			b.SetAttr(f.name, s)
+		} else {
+			b.SetTag(f.name, s)
+		}
+	case roleAttrs, roleTags: // not overriding the fields
+		vals := b.attrs
+		if f.role == roleTags {
+			vals = b.tags
+		}
+		for k, v := range fv.Interface().(map[string]string) {
+			if _, ok := vals[k]; ok {
+				continue
+			}
+			if f.role == roleAttrs {
+				b.SetAttr(k, v)
+			} else {
+				b.SetTag(k, v)
+			}
+		}
+	case roleSub, roleRel:
+		m, err := marshalNode(fv, f.kind, f.ns)
+		if err != nil || m == nil {
+			return err
+		}
+		if f.role == roleSub {
+			b.SetSub(f.name, m)
+		} else {
+			b.SetRel(f.name, m)
+		}
+	case roleList:
+		for i, n := 0, fv.Len(); i < n; i++ {
+			m, err := marshalNode(fv.Index(i), f.kind, f.ns)
+			if err != nil {
+				return fieldErr(fmt.Sprintf("[%d]", i), err)
+			}
+			b.AppendList(m) // nil as Nil
+		}
+	}
+	return nil
+}
+
+// marshalNode returns nil for nil pointers and Metas
+func marshalNode(v reflect.Value, kind, ns string) (Meta, error) {
+	if v.Type() == metaType {
+		m, _ := v.Interface().(Meta)
+		return m, nil
+	}
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+	return marshalStruct(v, kind, ns)
+}
+
+// Unmarshal sets the struct v points to from m; see Marshal. Fields without
+// a counterpart in m are left untouched.
+func Unmarshal(m Meta, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Expected pointer to struct, got %T", v)
+	}
+	return unmarshalStruct(orNil(m), rv.Elem(), "")
+}
+
+func unmarshalStruct(m Meta, v reflect.Value, kind string) error {
+	s, err := mpStructOf(v.Type())
+	if err != nil {
+		return err
+	}
+	if kind == "" {
+		kind = s.kind
+	}
+	if kind != "" && m.Kind() != kind {
+		return fmt.Errorf("Expected kind %s, got %s", kind, m.Kind())
+	}
+
+	claimed := map[string]map[string]bool{roleAttr: {}, roleTag: {}}
+	for _, f := range s.fields {
+		if f.role == roleAttr || f.role == roleTag {
+			claimed[f.role][f.name] = true
+		}
+	}
+	for _, f := range s.fields {
+		if err := unmarshalField(m, f, fieldByIndexAlloc(v, f.index), claimed); err != nil {
+			return fieldErr(f.goName, err)
+		}
+	}
+	return nil
+}
+
+func unmarshalField(m Meta, f mpField, fv reflect.Value, claimed map[string]map[string]bool) error {
+	switch f.role {
+	case roleKind:
+		fv.SetString(m.Kind())
+	case roleNs:
+		fv.SetString(m.Ns())
+	case roleGid:
+		fv.SetString(m.Gid())
+	case roleMethod:
+		fv.SetString(m.Method())
+	case rolePayload:
+		if fv.Type() == bytesType {
+			fv.SetBytes(m.PayloadBytes())
+		} else {
+			fv.SetString(m.Payload())
+		}
+	case roleAttr, roleTag:
+		val, ok := m.AttrOk(f.name)
+		if f.role == roleTag {
+			val, ok = m.Tag(f.name), m.HasTag(f.name)
+		}
+		if !ok {
+			return nil
+		}
+		t := fv.Type()
+		if _, direct := codecFor(t); !direct { // pointer to a codec type
+			t = t.Elem()
+		}
+		pv, err := parseValue(f.name, val, true, t)
+		if err != nil {
+			return err
+		}
+		if t != fv.Type() {
+			ptr := reflect.New(t)
+			ptr.Elem().Set(pv)
+			pv = ptr
+		}
+		fv.Set(pv)
+	case roleAttrs, roleTags:
+		vals := map[string]string{}
+		names, get := m.AttrNames(), m.Attr
+		if f.role == roleTags {
+			names, get = m.TagNames(), func(name string, _ ...string) string { return m.Tag(name) }
+		}
+		for _, name := range names {
+			if !claimed[f.role[:len(f.role)-1]][name] {
+				vals[name] = get(name)
+			}
+		}
+		fv.Set(reflect.ValueOf(vals))
+	case roleSub, roleRel:
+		var child Meta
+		if f.role == roleSub && m.HasSub(f.name) {
+			child = m.Sub(f.name)
+		} else if f.role == roleRel && m.HasRel(f.name) {
+			child = m.Rel(f.name)
+		}
+		if child != nil {
+			return unmarshalNode(child, fv, f.kind)
+		}
+	case roleList:
+		list := m.List()
+		sv := reflect.MakeSlice(fv.Type(), len(list), len(list))
+		for i, item := range list {
+			if err := unmarshalNode(item, sv.Index(i), f.kind); err != nil {
+				return fieldErr(fmt.Sprintf("[%d]", i), err)
+			}
+		}
+		fv.Set(sv)
+	}
+	return nil
+}
+
+// fieldByIndexAlloc is FieldByIndex allocating nil embedded pointers
+func fieldByIndexAlloc(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+func unmarshalNode(m Meta, v reflect.Value, kind string) error {
+	if v.Type() == metaType {
+		v.Set(reflect.ValueOf(&m).Elem())
+		return nil
+	}
+	if v.Kind() == reflect.Pointer {
+		if m.IsNil() {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	return unmarshalStruct(m, v, kind)
+}
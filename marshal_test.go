@@ -0,0 +1,89 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"bytes"
+	"testing"
+)
+
+type marshalBase struct {
+	Gid  string `mp:",gid"`
+	Note string
+}
+
+type marshalDoc struct {
+	*marshalBase
+	Kind   string `mp:",kind"`
+	Title  string
+	Data   []byte
+	Labels []string          // skipped
+	Extra  map[string]string // skipped
+}
+
+type MarshalInner struct {
+	Kind  string `mp:",kind"`
+	Inner string
+}
+
+type marshalOuter struct {
+	*MarshalInner
+	Outer string
+}
+
+func TestMarshalDefaults(t *testing.T) {
+	doc := marshalDoc{Title: "logo", Data: []byte{0, 1, 2}, Labels: []string{"a"}, Extra: map[string]string{"x": "y"}}
+	m, err := Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := New("marshalDoc").WithAttr("Title", "logo").WithBytesPayload([]byte{0, 1, 2}, "")
+	if !Equal(m, want) || m.PayloadType() != DefaultPayloadType {
+		t.Errorf("got %s, want %s", CanonicalJson(m), CanonicalJson(want))
+	}
+
+	var back marshalDoc
+	if err := Unmarshal(m.WithGid("d-1"), &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.Title != "logo" || !bytes.Equal(back.Data, doc.Data) || back.marshalBase != nil {
+		t.Errorf("got %+v", back)
+	}
+}
+
+func TestMarshalEmbeddedPointer(t *testing.T) {
+	m, err := Marshal(marshalOuter{&MarshalInner{Kind: "P", Inner: "in"}, "out"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := New("P").WithAttr("Inner", "in", "Outer", "out"); !Equal(m, want) {
+		t.Errorf("got %s, want %s", CanonicalJson(m), CanonicalJson(want))
+	}
+
+	if m, err = Marshal(marshalOuter{Outer: "out"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := New("marshalOuter").WithAttr("Outer", "out"); !Equal(m, want) {
+		t.Errorf("got %s, want %s", CanonicalJson(m), CanonicalJson(want))
+	}
+
+	var back marshalOuter
+	if err := Unmarshal(New("P").WithAttr("Inner", "in"), &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.MarshalInner == nil || back.Kind != "P" || back.Inner != "in" {
+		t.Errorf("got %+v", back)
+	}
+}
+
+func TestMarshalNoKind(t *testing.T) {
+	if m, err := Marshal(struct{ A string }{"x"}); err == nil {
+		t.Errorf("got %s", CanonicalJson(m))
+	}
+	if m, err := Marshal(struct {
+		_ struct{} `mp:",kind=A"`
+		A string
+	}{A: "x"}); err != nil || !Equal(m, New("A").WithAttr("A", "x")) {
+		t.Errorf("got %v, %v", m, err)
+	}
+}
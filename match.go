@@ -0,0 +1,249 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"strings"
+)
+
+// A pattern is a plain Meta whose strings may hold variables:
+//
+//	"?id"  binds (or must equal the earlier binding of) the variable id
+//	"*"    matches anything without binding ("?" does the same)
+//	"\?x"  the literal "?x", as "\*" is "*" and "\\x" is "\x"
+//
+// Kind, tag and attr values and the payload may be variables, as may method,
+// ns and gid, which also match anything when empty. A tag, attr, sub or rel
+// name ending with "?" is optional. Tags, attrs, subs and rels not in the
+// pattern are ignored. List items match by position; an item of kind "..."
+// matches the rest of the list. A node of kind "?x" also binds the whole
+// node to x (the first one if x appears more than once).
+
+const restKind = "..."
+
+type Bindings struct {
+	Values map[string]string
+	Nodes  map[string]Meta
+}
+
+// Var returns the pattern node that matches and binds any node.
+func Var(name string) Meta {
+	return New("?" + name)
+}
+
+func Match(pattern, m Meta) (Bindings, bool) {
+	b := Bindings{map[string]string{}, map[string]Meta{}}
+	if !matchMeta(pattern, m, b) {
+		return Bindings{}, false
+	}
+	return b, true
+}
+
+// Matches reports whether m matches pattern, ignoring the bindings.
+func Matches(pattern, m Meta) bool {
+	_, ok := Match(pattern, m)
+	return ok
+}
+
+func matchMeta(p, m Meta, b Bindings) bool {
+	if IsNil(p) {
+		return IsNil(m)
+	}
+	if IsNil(m) {
+		return false
+	}
+
+	kind := p.Kind()
+	if !matchStr(kind, m.Kind(), b) {
+		return false
+	}
+	if name, ok := varName(kind); ok && name != "" {
+		if _, ok := b.Nodes[name]; !ok {
+			b.Nodes[name] = m
+		}
+	}
+
+	for _, pair := range [][2]string{{p.Method(), m.Method()}, {p.Ns(), m.Ns()}, {p.Gid(), m.Gid()}, {p.Payload(), m.Payload()}} {
+		if pair[0] != "" && !matchStr(pair[0], pair[1], b) {
+			return false
+		}
+	}
+
+	for _, name := range p.TagNames() {
+		key, opt := optionalName(name)
+		if !m.HasTag(key) {
+			if opt {
+				continue
+			}
+			return false
+		}
+		if !matchStr(p.Tag(name), m.Tag(key), b) {
+			return false
+		}
+	}
+
+	for _, name := range p.AttrNames() {
+		key, opt := optionalName(name)
+		val, ok := m.AttrOk(key)
+		if !ok {
+			if opt {
+				continue
+			}
+			return false
+		}
+		if !matchStr(p.Attr(name), val, b) {
+			return false
+		}
+	}
+
+	for _, name := range p.SubNames() {
+		key, opt := optionalName(name)
+		if sub := m.Sub(key); !(opt && sub.IsNil()) && !matchMeta(p.Sub(name), sub, b) {
+			return false
+		}
+	}
+	for _, name := range p.RelNames() {
+		key, opt := optionalName(name)
+		if rel := m.Rel(key); !(opt && rel.IsNil()) && !matchMeta(p.Rel(name), rel, b) {
+			return false
+		}
+	}
+
+	return matchList(p.List(), m.List(), b)
+}
+
+func matchList(ps, ms []Meta, b Bindings) bool {
+	for i, p := range ps {
+		if p.Kind() == restKind {
+			return true
+		}
+		if i >= len(ms) || !matchMeta(p, ms[i], b) {
+			return false
+		}
+	}
+	return len(ps) == len(ms) || len(ps) == 0
+}
+
+func matchStr(p, v string, b Bindings) bool {
+	if p == "*" {
+		return true
+	}
+	if name, ok := varName(p); ok {
+		if name == "" {
+			return true
+		}
+		if val, ok := b.Values[name]; ok {
+			return val == v
+		}
+		b.Values[name] = v
+		return true
+	}
+	return unescapeVar(p) == v
+}
+
+// varName returns the variable name of "?name"
+func varName(s string) (string, bool) {
+	if strings.HasPrefix(s, "?") {
+		return s[1:], true
+	}
+	return "", false
+}
+
+// unescapeVar drops a leading "\" before "?", "*" or "\"
+func unescapeVar(s string) string {
+	if len(s) > 1 && s[0] == '\\' && strings.IndexByte(`?*\`, s[1]) >= 0 {
+		return s[1:]
+	}
+	return s
+}
+
+func optionalName(name string) (string, bool) {
+	if strings.HasSuffix(name, "?") {
+		return name[:len(name)-1], true
+	}
+	return name, false
+}
+
+// Instantiate builds a Meta from template by substituting bound variables;
+// "*" counts as unbound. A node with an unbound kind is Nil. Tags and attrs
+// with unbound variables are dropped, as are optional subs and rels that
+// instantiate to Nil and list items of kind "...". A node of kind "?x" with
+// nothing else is replaced by the node bound to x.
+func Instantiate(template Meta, b Bindings) Meta {
+	if IsNil(template) {
+		return Nil
+	}
+
+	if name, ok := varName(template.Kind()); ok && isBareNode(template) {
+		if n, ok := b.Nodes[name]; ok {
+			return n
+		}
+	}
+	kind, ok := substStr(template.Kind(), b)
+	if !ok || kind == "" {
+		return Nil
+	}
+
+	mthd, _ := substStr(template.Method(), b)
+	ns, _ := substStr(template.Ns(), b)
+	gid, _ := substStr(template.Gid(), b)
+	payload, _ := substStr(template.Payload(), b)
+
+	tags := map[string]string{}
+	for _, name := range template.TagNames() {
+		if val, ok := substStr(template.Tag(name), b); ok {
+			key, _ := optionalName(name)
+			tags[key] = val
+		}
+	}
+	attrs := map[string]string{}
+	for _, name := range template.AttrNames() {
+		if val, ok := substStr(template.Attr(name), b); ok {
+			key, _ := optionalName(name)
+			attrs[key] = val
+		}
+	}
+
+	ret := New(kind, mthd, ns, gid).WithTags(tags).WithAttrs(attrs).WithPayload(payload)
+	if ctype := template.PayloadType(); ctype != "" { // bytes as they are
+		ret = ret.WithBytesPayload(template.PayloadBytes(), ctype)
+	}
+	for _, name := range template.SubNames() {
+		key, opt := optionalName(name)
+		if sub := Instantiate(template.Sub(name), b); !opt || !sub.IsNil() {
+			ret = ret.WithSub(key, sub)
+		}
+	}
+	for _, name := range template.RelNames() {
+		key, opt := optionalName(name)
+		if rel := Instantiate(template.Rel(name), b); !opt || !rel.IsNil() {
+			ret = ret.WithRel(key, rel)
+		}
+	}
+
+	var list []Meta
+	for _, item := range template.List() {
+		if item.Kind() != restKind {
+			list = append(list, Instantiate(item, b))
+		}
+	}
+	return ret.WithList(list)
+}
+
+func isBareNode(m Meta) bool {
+	return m.Method() == "" && m.Ns() == "" && m.Gid() == "" && m.Payload() == "" &&
+		m.TagCount() == 0 && m.AttrCount() == 0 && m.SubCount() == 0 && m.RelCount() == 0 &&
+		len(m.List()) == 0
+}
+
+// substStr returns the bound value of a variable, or false if unbound
+func substStr(s string, b Bindings) (string, bool) {
+	if s == "*" {
+		return "", false
+	}
+	if name, ok := varName(s); ok {
+		val, ok := b.Values[name]
+		return val, ok
+	}
+	return unescapeVar(s), true
+}
@@ -5,6 +5,9 @@ package mp
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var Nil Meta = &meta{}
@@ -25,24 +28,43 @@ type Meta interface {
 	WithAttr(args ...string) Meta
 	WithNonEmptyAttr(args ...string) Meta
 	WithAttrs(map[string]string) Meta
+	WithIntAttr(name string, value int) Meta
+	WithBoolAttr(name string, value bool) Meta
+	WithFloatAttr(name string, value float64) Meta
+	WithDateAttr(name string, value time.Time) Meta
+	WithTimeAttr(name, layout string, value time.Time) Meta
+	WithUtcAttr(name string, value time.Time) Meta
+	WithDurationAttr(name string, value time.Duration) Meta
+	WithIntsAttr(name, sep string, values []int) Meta
+	WithoutTag(names ...string) Meta
+	WithoutAttr(names ...string) Meta
 
 	WithPayload(data string) Meta
+	WithBytesPayload(data []byte, contentType string) Meta
+	WithoutPayload() Meta
 
 	WithSub(name string, sub Meta) Meta
 	WithSubs(map[string]Meta) Meta
+	WithoutSub(names ...string) Meta
 	HasSub(name string) bool
 	Sub(name string) Meta
-	SubNames() []string
+	SubNames() []string // sorted
 	SubCount() int
 
 	WithRel(name string, rel Meta) Meta
 	WithRels(map[string]Meta) Meta
+	// WithRelRef relates target by a Ref rather than a copy; m is returned
+	// unchanged if target is Nil or has no gid, as the Ref could not resolve
+	WithRelRef(name string, target Meta) Meta
+	WithoutRel(names ...string) Meta
 	HasRel(name string) bool
 	Rel(name string) Meta
-	RelNames() []string
+	RelNames() []string // sorted
 	RelCount() int
 
 	WithList(list []Meta, trims ...bool) Meta
+	WithListItem(index int, item Meta) Meta
+	WithoutListItem(index int) Meta
 	List() []Meta
 	ListItem(index int) Meta
 
@@ -54,21 +76,11 @@ type Meta interface {
 	Json(opts ...string) string
 }
 
-type Visitor interface {
-	BeginMeta(m Meta, kind, method, ns, gid string) // add uppers later
-	OnTag(m Meta, name, value string)
-	OnAttr(m Meta, name, value string)
-	OnSub(m Meta, name string, sub Meta)
-	OnRel(m Meta, name string, rel Meta)
-	OnListItem(m Meta, index int, item Meta)
-	EndMeta(m Meta)
-}
-
 type meta struct {
 	info
-	subs map[string]Meta // assert subs has no nil
-	rels map[string]Meta // assert rels has no nil
-	list []Meta          // assert list has no nil
+	subs metaMap // assert subs has no nil
+	rels metaMap // assert rels has no nil
+	list []Meta  // assert list has no nil
 }
 
 func New(kind string, args ...string) Meta {
@@ -82,7 +94,7 @@ func New(kind string, args ...string) Meta {
 	default:
 		mthd, ns, gid = args[0], args[1], args[2]
 	}
-	return &meta{info{kind, mthd, ns, gid, nil, nil, ""}, nil, nil, nil}
+	return &meta{info{kind, mthd, ns, gid, strMap{}, strMap{}, payloadData{}}, metaMap{}, metaMap{}, nil}
 }
 
 func IsNil(m Meta) bool {
@@ -127,31 +139,40 @@ func (m *meta) ErrorCode(otherwise int) int {
 }
 
 func (m *meta) WithMethod(mthd string) Meta {
+	if mthd == m.mthd {
+		return m
+	}
 	return &meta{info{m.kind, mthd, m.ns, m.gid, m.tags, m.attrs, m.payload}, m.subs, m.rels, m.list}
 }
 
 func (m *meta) WithGid(gid string) Meta {
+	if gid == m.gid {
+		return m
+	}
 	return &meta{info{m.kind, m.mthd, m.ns, gid, m.tags, m.attrs, m.payload}, m.subs, m.rels, m.list} // better to enumerate all
 }
 
 func (m *meta) WithTag(name, value string, rest ...string) Meta {
 	restn := len(rest) / 2
-	tags := copyStrMap(m.tags, 1+restn)
-	tags[name] = value
+	if hasValue(m.tags, append([]string{name, value}, rest[:2*restn]...)) {
+		return m
+	}
+
+	tags := m.tags.Set(name, value)
 	for i := 0; i < restn; i++ {
-		tags[rest[2*i]] = rest[2*i+1]
+		tags = tags.Set(rest[2*i], rest[2*i+1])
 	}
 	return &meta{info{m.kind, m.mthd, m.ns, m.gid, tags, m.attrs, m.payload}, m.subs, m.rels, m.list} // better to enumerate all
 }
 
 func (m *meta) WithTags(ts map[string]string) Meta {
-	if len(ts) == 0 {
+	if len(ts) == 0 || hasValues(m.tags, ts) {
 		return m
 	}
 
-	tags := copyStrMap(m.tags, len(ts))
+	tags := m.tags
 	for k, v := range ts {
-		tags[k] = v
+		tags = tags.Set(k, v)
 	}
 	return &meta{info{m.kind, m.mthd, m.ns, m.gid, tags, m.attrs, m.payload}, m.subs, m.rels, m.list}
 }
@@ -168,38 +189,130 @@ func (m *meta) withAttr(skip bool, args []string) Meta {
 	argn := len(args) / 2
 	changed := 0
 	for i := 0; i < argn; i++ {
-		if !skip || args[2*i+1] != "" {
-			changed += 1
+		if val := args[2*i+1]; !skip || val != "" {
+			if old, ok := m.attrs.Get(args[2*i]); !ok || old != val {
+				changed += 1
+			}
 		}
 	}
 	if changed == 0 {
 		return m
 	}
 
-	attrs := copyStrMap(m.attrs, changed)
+	attrs := m.attrs
 	for i := 0; i < argn; i++ {
 		if val := args[2*i+1]; !skip || val != "" {
-			attrs[args[2*i]] = val
+			attrs = attrs.Set(args[2*i], val)
 		}
 	}
 	return &meta{info{m.kind, m.mthd, m.ns, m.gid, m.tags, attrs, m.payload}, m.subs, m.rels, m.list}
 }
 
 func (m *meta) WithAttrs(ts map[string]string) Meta {
-	if len(ts) == 0 {
+	if len(ts) == 0 || hasValues(m.attrs, ts) {
 		return m
 	}
 
-	attrs := copyStrMap(m.attrs, len(ts))
+	attrs := m.attrs
 	for k, v := range ts {
-		attrs[k] = v
+		attrs = attrs.Set(k, v)
 	}
 	return &meta{info{m.kind, m.mthd, m.ns, m.gid, m.tags, attrs, m.payload}, m.subs, m.rels, m.list}
 }
 
+// typed attrs, formatted so that the Info getters read them back
+
+func (m *meta) WithIntAttr(name string, value int) Meta {
+	return m.WithAttr(name, strconv.Itoa(value))
+}
+
+func (m *meta) WithBoolAttr(name string, value bool) Meta {
+	return m.WithAttr(name, strconv.FormatBool(value))
+}
+
+// WithFloatAttr uses the shortest representation that parses back to value.
+func (m *meta) WithFloatAttr(name string, value float64) Meta {
+	return m.WithAttr(name, strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+// WithDateAttr keeps only the date of value in its own location.
+func (m *meta) WithDateAttr(name string, value time.Time) Meta {
+	return m.WithAttr(name, value.Format(UtcDateFormat))
+}
+
+func (m *meta) WithTimeAttr(name, layout string, value time.Time) Meta {
+	return m.WithAttr(name, value.Format(layout))
+}
+
+// WithUtcAttr converts value to UTC in UtcTimeFormat, with nanoseconds if
+// value has a fraction of a millisecond, so UtcAttr reads back an Equal time.
+func (m *meta) WithUtcAttr(name string, value time.Time) Meta {
+	return m.WithAttr(name, formatUtc(value))
+}
+
+// WithDurationAttr writes value as time.Duration.String, read back by
+// DurationAttr.
+func (m *meta) WithDurationAttr(name string, value time.Duration) Meta {
+	return m.WithAttr(name, value.String())
+}
+
+// WithIntsAttr joins values with sep, which must not contain digits or "-".
+func (m *meta) WithIntsAttr(name, sep string, values []int) Meta {
+	words := make([]string, len(values))
+	for i, v := range values {
+		words[i] = strconv.Itoa(v)
+	}
+	return m.WithAttr(name, strings.Join(words, sep))
+}
+
+func (m *meta) WithoutTag(names ...string) Meta {
+	if tags, changed := without(m.tags, names); changed {
+		return &meta{info{m.kind, m.mthd, m.ns, m.gid, tags, m.attrs, m.payload}, m.subs, m.rels, m.list}
+	}
+	return m
+}
+
+func (m *meta) WithoutAttr(names ...string) Meta {
+	if attrs, changed := without(m.attrs, names); changed {
+		return &meta{info{m.kind, m.mthd, m.ns, m.gid, m.tags, attrs, m.payload}, m.subs, m.rels, m.list}
+	}
+	return m
+}
+
+func without[V any](vals pmap[V], names []string) (pmap[V], bool) {
+	ret := vals
+	for _, name := range names {
+		ret = ret.Delete(name)
+	}
+	return ret, ret.Len() != vals.Len()
+}
+
 // payload
 
+func (m *meta) WithoutPayload() Meta {
+	return m.WithPayload("")
+}
+
+// WithPayload sets a text payload.
 func (m *meta) WithPayload(payload string) Meta {
+	return m.withPayload(payloadData{data: payload})
+}
+
+// WithBytesPayload sets a bytes payload of the content type, by default
+// DefaultPayloadType; it is written base64 in JSON and raw in binary. An
+// empty payload has no type, so empty data removes the payload, type and
+// all, as WithoutPayload does.
+func (m *meta) WithBytesPayload(data []byte, contentType string) Meta {
+	if len(data) == 0 {
+		return m.WithoutPayload()
+	}
+	if contentType == "" {
+		contentType = DefaultPayloadType
+	}
+	return m.withPayload(payloadData{string(data), contentType})
+}
+
+func (m *meta) withPayload(payload payloadData) Meta {
 	if payload == m.payload {
 		return m
 	}
@@ -209,14 +322,14 @@ func (m *meta) WithPayload(payload string) Meta {
 // subs
 
 func (m *meta) Sub(name string) Meta {
-	if ret, ok := m.subs[name]; ok {
+	if ret, ok := m.subs.Get(name); ok {
 		return ret
 	}
 	return Nil
 }
 
 func (m *meta) HasSub(name string) bool {
-	sub, ok := m.subs[name]
+	sub, ok := m.subs.Get(name)
 	return ok && !sub.IsNil() // make sure subs no nil
 }
 
@@ -227,23 +340,12 @@ func (m *meta) WithSub(name string, sub Meta) Meta {
 	return m
 }
 
-func withSub(subs map[string]Meta, name string, sub Meta) (map[string]Meta, bool) {
-	ch, ok := subs[name]
+func withSub(subs metaMap, name string, sub Meta) (metaMap, bool) {
+	ch, ok := subs.Get(name)
 	if sub == nil || ok && sub == ch {
 		return subs, false
 	}
-
-	more := 1
-	if ok {
-		more = 0
-	}
-
-	newSubs := make(map[string]Meta, len(subs)+more)
-	for k, v := range subs {
-		newSubs[k] = v
-	}
-	newSubs[name] = sub
-	return newSubs, true
+	return subs.Set(name, sub), true
 }
 
 func (m *meta) WithSubs(subs map[string]Meta) Meta {
@@ -262,16 +364,19 @@ func (m *meta) WithSubs(subs map[string]Meta) Meta {
 	return &meta{info{m.kind, m.mthd, m.ns, m.gid, m.tags, m.attrs, m.payload}, newSubs, m.rels, m.list}
 }
 
+func (m *meta) WithoutSub(names ...string) Meta {
+	if subs, changed := without(m.subs, names); changed {
+		return &meta{info{m.kind, m.mthd, m.ns, m.gid, m.tags, m.attrs, m.payload}, subs, m.rels, m.list}
+	}
+	return m
+}
+
 func (m *meta) SubCount() int {
-	return len(m.subs)
+	return m.subs.Len()
 }
 
 func (m *meta) SubNames() []string {
-	names := make([]string, 0, len(m.subs))
-	for name := range m.subs {
-		names = append(names, name)
-	}
-	return names
+	return m.subs.Keys()
 }
 
 func (m *meta) WithList(list []Meta, trims ...bool) Meta {
@@ -292,24 +397,37 @@ func (m *meta) WithList(list []Meta, trims ...bool) Meta {
 		}
 	}
 
-	if len(newList) == 0 && len(m.list) == 0 {
+	if sameList(newList, m.list) {
 		return m
 	}
 
 	return &meta{info{m.kind, m.mthd, m.ns, m.gid, m.tags, m.attrs, m.payload}, m.subs, m.rels, newList}
 }
 
+// sameList compares items by identity, not with Equal, to keep WithList cheap
+func sameList(as, bs []Meta) bool {
+	if len(as) != len(bs) {
+		return false
+	}
+	for i := range as {
+		if as[i] != bs[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // rels
 
 func (m *meta) Rel(name string) Meta {
-	if ret, ok := m.rels[name]; ok {
+	if ret, ok := m.rels.Get(name); ok {
 		return ret
 	}
 	return Nil
 }
 
 func (m *meta) HasRel(name string) bool {
-	rel, ok := m.rels[name]
+	rel, ok := m.rels.Get(name)
 	return ok && !rel.IsNil()
 }
 
@@ -336,16 +454,26 @@ func (m *meta) WithRels(rels map[string]Meta) Meta {
 	return &meta{info{m.kind, m.mthd, m.ns, m.gid, m.tags, m.attrs, m.payload}, m.subs, newRels, m.list}
 }
 
+func (m *meta) WithoutRel(names ...string) Meta {
+	if rels, changed := without(m.rels, names); changed {
+		return &meta{info{m.kind, m.mthd, m.ns, m.gid, m.tags, m.attrs, m.payload}, m.subs, rels, m.list}
+	}
+	return m
+}
+
+func (m *meta) WithRelRef(name string, target Meta) Meta {
+	if IsNil(target) || target.Gid() == "" {
+		return m
+	}
+	return m.WithRel(name, Ref(target))
+}
+
 func (m *meta) RelCount() int {
-	return len(m.rels)
+	return m.rels.Len()
 }
 
 func (m *meta) RelNames() []string {
-	names := make([]string, 0, len(m.rels))
-	for name := range m.rels {
-		names = append(names, name)
-	}
-	return names
+	return m.rels.Keys()
 }
 
 // list
@@ -358,18 +486,48 @@ func (m *meta) ListItem(idx int) Meta {
 	if idx >= 0 && idx < len(m.list) {
 		return m.list[idx]
 	}
-	return nil
+	return Nil
+}
+
+// WithListItem replaces the item at index, keeping Nil in place of nil
+func (m *meta) WithListItem(idx int, item Meta) Meta {
+	if idx < 0 || idx >= len(m.list) {
+		return m
+	}
+	if item == nil {
+		item = Nil
+	}
+	if item == m.list[idx] {
+		return m
+	}
+
+	newList := make([]Meta, len(m.list))
+	copy(newList, m.list)
+	newList[idx] = item
+	return &meta{info{m.kind, m.mthd, m.ns, m.gid, m.tags, m.attrs, m.payload}, m.subs, m.rels, newList}
+}
+
+func (m *meta) WithoutListItem(idx int) Meta {
+	if idx < 0 || idx >= len(m.list) {
+		return m
+	}
+
+	newList := make([]Meta, 0, len(m.list)-1)
+	newList = append(newList, m.list[:idx]...)
+	newList = append(newList, m.list[idx+1:]...)
+	return &meta{info{m.kind, m.mthd, m.ns, m.gid, m.tags, m.attrs, m.payload}, m.subs, m.rels, newList}
 }
 
 func (m *meta) Generalizes(n Meta) bool {
-	if m.Kind() == n.Kind() {
-		for k, v := range m.tags {
-			if !n.HasTag(k, v) {
-				return false
-			}
-		}
+	if n == nil || m.Kind() != n.Kind() {
+		return false
 	}
-	return true
+	ok := true
+	m.tags.Range(func(k, v string) bool {
+		ok = n.HasTag(k, v)
+		return ok
+	})
+	return ok
 }
 
 func (m *meta) Specializes(n Meta) bool {
@@ -382,28 +540,6 @@ func (m *meta) Walk(v Visitor) {
 	Walk(m, v)
 }
 
-func Walk(m Meta, v Visitor) {
-	v.BeginMeta(m, m.Kind(), m.Method(), m.Ns(), m.Gid())
-	for _, name := range m.TagNames() {
-		v.OnTag(m, name, m.Tag(name))
-	}
-	for _, name := range m.SubNames() {
-		v.OnSub(m, name, m.Sub(name))
-		Walk(m.Sub(name), v)
-	}
-	for _, name := range m.RelNames() {
-		v.OnRel(m, name, m.Rel(name))
-		Walk(m.Rel(name), v)
-	}
-
-	for idx, item := range m.List() {
-		v.OnListItem(m, idx, item)
-		Walk(item, v)
-	}
-
-	v.EndMeta(m)
-}
-
 func (m *meta) MarshalJSON() ([]byte, error) {
 	return json.Marshal(MetaToJson(m))
 }
@@ -433,3 +569,19 @@ func FirstIs(ms []Meta, kind, ns string, tags ...string) Meta {
 	}
 	return Nil
 }
+
+func CopySubs(m Meta) map[string]Meta {
+	ret := make(map[string]Meta, m.SubCount())
+	for _, name := range m.SubNames() {
+		ret[name] = m.Sub(name)
+	}
+	return ret
+}
+
+func CopyRels(m Meta) map[string]Meta {
+	ret := make(map[string]Meta, m.RelCount())
+	for _, name := range m.RelNames() {
+		ret[name] = m.Rel(name)
+	}
+	return ret
+}
@@ -0,0 +1,507 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	OpSet    = "set"
+	OpRemove = "remove"
+	OpInsert = "insert"
+	OpDelete = "delete"
+)
+
+// PatchOp is a single change to a Meta tree. Path is a JSON pointer over the
+// MetaJson layout, e.g. "/subs/customer/attrs/name" or "/list/3". Value holds
+// the new tag, attr or payload string; Meta holds the new node for subs, rels,
+// list items or the root (""). PayloadType is the content type when Value is
+// a bytes payload.
+type PatchOp struct {
+	Op          string
+	Path        string
+	Value       string
+	PayloadType string
+	Meta        Meta
+}
+
+type Patch []PatchOp
+
+// Diff returns the operations that turn old into new.
+func Diff(old, new Meta) Patch {
+	var ops Patch
+	diffMeta("", old, new, &ops)
+	return ops
+}
+
+func diffMeta(path string, a, b Meta, ops *Patch) {
+	if Equal(a, b) {
+		return
+	}
+	if !sameNode(a, b) {
+		*ops = append(*ops, PatchOp{Op: OpSet, Path: path, Meta: orNil(b)})
+		return
+	}
+
+	diffStrs(path+"/tags/", CopyTags(a), CopyTags(b), ops)
+	diffStrs(path+"/attrs/", CopyAttrs(a), CopyAttrs(b), ops)
+
+	if a.Payload() != b.Payload() || a.PayloadType() != b.PayloadType() {
+		if b.Payload() == "" {
+			*ops = append(*ops, PatchOp{Op: OpRemove, Path: path + "/payload"})
+		} else {
+			*ops = append(*ops, PatchOp{Op: OpSet, Path: path + "/payload", Value: b.Payload(), PayloadType: b.PayloadType()})
+		}
+	}
+
+	diffMetas(path+"/subs/", a.SubNames(), b.SubNames(), a.Sub, b.Sub, ops)
+	diffMetas(path+"/rels/", a.RelNames(), b.RelNames(), a.Rel, b.Rel, ops)
+	diffList(path+"/list/", a.List(), b.List(), ops)
+}
+
+// sameNode tells if a and b can be diffed field by field rather than replaced
+func sameNode(a, b Meta) bool {
+	return !IsNil(a) && !IsNil(b) && a.Kind() == b.Kind() && a.Method() == b.Method() &&
+		a.Ns() == b.Ns() && a.Gid() == b.Gid()
+}
+
+func orNil(m Meta) Meta {
+	if m == nil {
+		return Nil
+	}
+	return m
+}
+
+func diffStrs(prefix string, as, bs map[string]string, ops *Patch) {
+	for _, name := range mapKeys(as) {
+		if _, ok := bs[name]; !ok {
+			*ops = append(*ops, PatchOp{Op: OpRemove, Path: prefix + escapePointer(name)})
+		}
+	}
+	for _, name := range mapKeys(bs) {
+		if val, ok := as[name]; !ok || val != bs[name] {
+			*ops = append(*ops, PatchOp{Op: OpSet, Path: prefix + escapePointer(name), Value: bs[name]})
+		}
+	}
+}
+
+func diffMetas(prefix string, anames, bnames []string, aget, bget func(string) Meta, ops *Patch) {
+	aset, bset := nameSet(anames), nameSet(bnames)
+	for _, name := range anames {
+		if !bset[name] {
+			*ops = append(*ops, PatchOp{Op: OpRemove, Path: prefix + escapePointer(name)})
+		}
+	}
+	for _, name := range bnames {
+		if !aset[name] {
+			*ops = append(*ops, PatchOp{Op: OpSet, Path: prefix + escapePointer(name), Meta: bget(name)})
+		} else {
+			diffMeta(prefix+escapePointer(name), aget(name), bget(name), ops)
+		}
+	}
+}
+
+// diffList aligns the two lists on their longest common subsequence; an item
+// replaced by one with the same kind, method, ns and gid is diffed in place.
+func diffList(prefix string, as, bs []Meta, ops *Patch) {
+	ah, bh := make([][32]byte, len(as)), make([][32]byte, len(bs))
+	for i, item := range as {
+		ah[i] = Hash(item)
+	}
+	for j, item := range bs {
+		bh[j] = Hash(item)
+	}
+
+	match := lcsMatch(ah, bh)
+	pos, i, j := 0, 0, 0
+	var dels, inss []Meta
+	flush := func() {
+		k := 0
+		for ; k < len(dels) && k < len(inss); k++ {
+			path := prefix + strconv.Itoa(pos)
+			if sameNode(dels[k], inss[k]) {
+				diffMeta(path, dels[k], inss[k], ops)
+			} else {
+				*ops = append(*ops, PatchOp{Op: OpDelete, Path: path},
+					PatchOp{Op: OpInsert, Path: path, Meta: inss[k]})
+			}
+			pos++
+		}
+		for _, item := range inss[k:] {
+			*ops = append(*ops, PatchOp{Op: OpInsert, Path: prefix + strconv.Itoa(pos), Meta: item})
+			pos++
+		}
+		for range dels[k:] {
+			*ops = append(*ops, PatchOp{Op: OpDelete, Path: prefix + strconv.Itoa(pos)})
+		}
+		dels, inss = nil, nil
+	}
+
+	for i < len(as) || j < len(bs) {
+		switch {
+		case i < len(as) && match[i] == j:
+			flush()
+			pos, i, j = pos+1, i+1, j+1
+		case j == len(bs) || i < len(as) && match[i] < 0:
+			dels = append(dels, as[i])
+			i++
+		default:
+			inss = append(inss, bs[j])
+			j++
+		}
+	}
+	flush()
+}
+
+// lcsMatch returns, for each item of as, the index of the item of bs it is
+// paired with in a longest common subsequence, or -1. It trims the common
+// prefix and suffix and runs the linear-space variant of Myers' algorithm,
+// in O((n+m)d) time for d differences and O(n+m) memory.
+func lcsMatch(as, bs [][32]byte) []int {
+	l := &lcs{as: as, bs: bs, match: make([]int, len(as))}
+	for i := range l.match {
+		l.match[i] = -1
+	}
+	size := 2*(len(as)+len(bs)) + 4
+	l.vf, l.vb = make([]int, size), make([]int, size)
+	l.compare(0, len(as), 0, len(bs))
+	return l.match
+}
+
+type lcs struct {
+	as, bs [][32]byte
+	vf, vb []int // furthest x by diagonal, forward and backward
+	match  []int
+}
+
+func (l *lcs) compare(a0, a1, b0, b1 int) {
+	for a0 < a1 && b0 < b1 && l.as[a0] == l.bs[b0] {
+		l.match[a0] = b0
+		a0, b0 = a0+1, b0+1
+	}
+	for a0 < a1 && b0 < b1 && l.as[a1-1] == l.bs[b1-1] {
+		a1, b1 = a1-1, b1-1
+		l.match[a1] = b1
+	}
+	if a0 == a1 || b0 == b1 {
+		return
+	}
+	x, y, u, v := l.middleSnake(a0, a1, b0, b1)
+	l.compare(a0, a0+x, b0, b0+y)
+	for k := 0; k < u-x; k++ {
+		l.match[a0+x+k] = b0 + y + k
+	}
+	l.compare(a0+u, a1, b0+v, b1)
+}
+
+// middleSnake finds the middle snake of an optimal edit path between
+// as[a0:a1] and bs[b0:b1], from (x, y) to (u, v) relative to (a0, b0)
+func (l *lcs) middleSnake(a0, a1, b0, b1 int) (x, y, u, v int) {
+	n, m := a1-a0, b1-b0
+	delta := n - m
+	odd := delta&1 != 0
+	off := n + m + 1 // diagonal k is at index off+k
+	vf, vb := l.vf, l.vb
+	vf[off+1], vb[off+1] = 0, 0
+	for d := 0; d <= (n+m+1)/2; d++ {
+		for k := -d; k <= d; k += 2 { // forward from (0, 0)
+			if k == -d || k != d && vf[off+k-1] < vf[off+k+1] {
+				x = vf[off+k+1]
+			} else {
+				x = vf[off+k-1] + 1
+			}
+			y = x - k
+			u, v = x, y
+			for u < n && v < m && l.as[a0+u] == l.bs[b0+v] {
+				u, v = u+1, v+1
+			}
+			vf[off+k] = u
+			if odd && delta-k >= -(d-1) && delta-k <= d-1 && u+vb[off+delta-k] >= n {
+				return x, y, u, v
+			}
+		}
+		for k := -d; k <= d; k += 2 { // backward from (n, m), on diagonal delta-k
+			if k == -d || k != d && vb[off+k-1] < vb[off+k+1] {
+				x = vb[off+k+1]
+			} else {
+				x = vb[off+k-1] + 1
+			}
+			y = x - k
+			u, v = x, y
+			for u < n && v < m && l.as[a1-1-u] == l.bs[b1-1-v] {
+				u, v = u+1, v+1
+			}
+			vb[off+k] = u
+			if !odd && delta-k >= -d && delta-k <= d && u+vf[off+delta-k] >= n {
+				return n - u, m - v, n - x, m - y
+			}
+		}
+	}
+	panic("lcs: no middle snake") // not reached
+}
+
+// Apply replays the patch on m and returns the result; m itself is unchanged.
+func (p Patch) Apply(m Meta) (Meta, error) {
+	ret := orNil(m)
+	for _, op := range p {
+		segs, err := splitPointer(op.Path)
+		if err == nil {
+			ret, err = applyOp(ret, segs, op)
+		}
+		if err != nil {
+			return m, fmt.Errorf("Patch %s %s: %v", op.Op, op.Path, err)
+		}
+	}
+	return ret, nil
+}
+
+func applyOp(m Meta, segs []string, op PatchOp) (Meta, error) {
+	if len(segs) == 0 {
+		if op.Op != OpSet {
+			return m, fmt.Errorf("Invalid op for a node")
+		}
+		return orNil(op.Meta), nil
+	}
+	if m.IsNil() {
+		return m, fmt.Errorf("Nil node")
+	}
+
+	field, rest := segs[0], segs[1:]
+	switch field {
+	case "payload":
+		if len(rest) != 0 {
+			return m, fmt.Errorf("Invalid path")
+		}
+		switch op.Op {
+		case OpSet:
+			if op.PayloadType != "" {
+				return m.WithBytesPayload([]byte(op.Value), op.PayloadType), nil
+			}
+			return m.WithPayload(op.Value), nil
+		case OpRemove:
+			return m.WithoutPayload(), nil
+		}
+	case "tags", "attrs":
+		if len(rest) != 1 {
+			return m, fmt.Errorf("Invalid path")
+		}
+		switch op.Op {
+		case OpSet:
+			if field == "tags" {
+				return m.WithTag(rest[0], op.Value), nil
+			}
+			return m.WithAttr(rest[0], op.Value), nil
+		case OpRemove:
+			if field == "tags" {
+				return m.WithoutTag(rest[0]), nil
+			}
+			return m.WithoutAttr(rest[0]), nil
+		}
+	case "subs", "rels":
+		if len(rest) == 0 {
+			return m, fmt.Errorf("Invalid path")
+		}
+		name, get, with, without := rest[0], m.Sub, m.WithSub, m.WithoutSub
+		if field == "rels" {
+			get, with, without = m.Rel, m.WithRel, m.WithoutRel
+		}
+		if len(rest) > 1 {
+			child, err := applyOp(get(name), rest[1:], op)
+			if err != nil {
+				return m, err
+			}
+			return with(name, child), nil
+		}
+		switch op.Op {
+		case OpSet:
+			return with(name, orNil(op.Meta)), nil
+		case OpRemove:
+			return without(name), nil
+		}
+	case "list":
+		if len(rest) == 0 {
+			return m, fmt.Errorf("Invalid path")
+		}
+		list := m.List()
+		idx, err := strconv.Atoi(rest[0])
+		if err != nil || idx < 0 || idx > len(list) || idx == len(list) && (op.Op != OpInsert || len(rest) > 1) {
+			return m, fmt.Errorf("Invalid list index %s", rest[0])
+		}
+		if len(rest) > 1 {
+			item, err := applyOp(list[idx], rest[1:], op)
+			if err != nil {
+				return m, err
+			}
+			return m.WithListItem(idx, item), nil
+		}
+		switch op.Op {
+		case OpSet:
+			return m.WithListItem(idx, op.Meta), nil
+		case OpInsert:
+			return m.WithList(insertList(list, idx, orNil(op.Meta)), false), nil
+		case OpDelete:
+			return m.WithoutListItem(idx), nil
+		}
+	default:
+		return m, fmt.Errorf("Invalid path")
+	}
+	return m, fmt.Errorf("Invalid op for %s", field)
+}
+
+func insertList(list []Meta, idx int, item Meta) []Meta {
+	ret := make([]Meta, 0, len(list)+1)
+	ret = append(ret, list[:idx]...)
+	ret = append(ret, item)
+	return append(ret, list[idx:]...)
+}
+
+// JSON pointers (RFC 6901)
+
+func escapePointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
+
+func unescapePointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~1", "/"), "~0", "~")
+}
+
+func splitPointer(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if path[0] != '/' {
+		return nil, fmt.Errorf("Invalid path")
+	}
+	segs := strings.Split(path[1:], "/")
+	for i, seg := range segs {
+		segs[i] = unescapePointer(seg)
+	}
+	return segs, nil
+}
+
+// isStrPath tells if the pointer addresses a tag, attr or payload string
+func isStrPath(path string) bool {
+	segs, _ := splitPointer(path)
+	n := len(segs)
+	return isPayloadPath(path) || n >= 2 && (segs[n-2] == "tags" || segs[n-2] == "attrs")
+}
+
+func isPayloadPath(path string) bool {
+	segs, _ := splitPointer(path)
+	n := len(segs)
+	return n >= 1 && segs[n-1] == "payload" && (n == 1 || segs[n-2] != "subs" && segs[n-2] != "rels")
+}
+
+func (p Patch) String() string {
+	var sb strings.Builder
+	for _, op := range p {
+		sb.WriteString(op.String())
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func (op PatchOp) String() string {
+	switch {
+	case op.Op == OpRemove || op.Op == OpDelete:
+		return fmt.Sprintf("%s %s", op.Op, op.Path)
+	case op.PayloadType != "":
+		return fmt.Sprintf("%s %s = %d bytes of %s", op.Op, op.Path, len(op.Value), op.PayloadType)
+	case isStrPath(op.Path):
+		return fmt.Sprintf("%s %s = %q", op.Op, op.Path, op.Value)
+	default:
+		return fmt.Sprintf("%s %s = %s", op.Op, op.Path, MetaToJson(op.Meta).Json())
+	}
+}
+
+// PatchOpJson
+
+// PatchOpJson carries a bytes payload as MetaJson does, in base64 as
+// PayloadEncoding says.
+type PatchOpJson struct {
+	Op              string          `json:"op"`
+	Path            string          `json:"path"`
+	Value           json.RawMessage `json:"value,omitempty"`
+	PayloadType     string          `json:"payloadType,omitempty"`
+	PayloadEncoding string          `json:"payloadEncoding,omitempty"`
+}
+
+func PatchToJson(p Patch) []PatchOpJson {
+	ret := make([]PatchOpJson, len(p))
+	for i, op := range p {
+		ret[i] = PatchOpJson{Op: op.Op, Path: op.Path}
+		switch {
+		case op.Op == OpRemove || op.Op == OpDelete:
+		case isPayloadPath(op.Path):
+			data, ctype, enc := encodePayloadData(op.Value, op.PayloadType)
+			ret[i].Value, _ = json.Marshal(data)
+			ret[i].PayloadType, ret[i].PayloadEncoding = ctype, enc
+		case isStrPath(op.Path):
+			ret[i].Value, _ = json.Marshal(op.Value)
+		default:
+			ret[i].Value, _ = json.Marshal(MetaToJson(op.Meta))
+		}
+	}
+	return ret
+}
+
+func JsonToPatch(ops []PatchOpJson) (Patch, error) {
+	ret := make(Patch, len(ops))
+	for i, oj := range ops {
+		ret[i] = PatchOp{Op: oj.Op, Path: oj.Path}
+		switch {
+		case len(oj.Value) == 0:
+		case isStrPath(oj.Path):
+			if err := json.Unmarshal(oj.Value, &ret[i].Value); err != nil {
+				return nil, fmt.Errorf("Patch %s %s: %v", oj.Op, oj.Path, err)
+			}
+			if isPayloadPath(oj.Path) {
+				payload, err := decodePayload(ret[i].Value, oj.PayloadType, oj.PayloadEncoding)
+				if err != nil {
+					return nil, fmt.Errorf("Patch %s %s: Invalid payload: %v", oj.Op, oj.Path, err)
+				}
+				ret[i].Value, ret[i].PayloadType = payload.data, payload.ctype
+			}
+		default:
+			var mj MetaJson
+			if err := json.Unmarshal(oj.Value, &mj); err != nil {
+				return nil, fmt.Errorf("Patch %s %s: %v", oj.Op, oj.Path, err)
+			}
+			if err := mj.checkPayloads(); err != nil {
+				return nil, fmt.Errorf("Patch %s %s: %v", oj.Op, oj.Path, err)
+			}
+			ret[i].Meta = JsonToMeta(mj)
+		}
+	}
+	return ret, nil
+}
+
+func ParsePatch(buf []byte) (Patch, error) {
+	var ops []PatchOpJson
+	if err := json.Unmarshal(buf, &ops); err != nil {
+		return nil, err
+	}
+	return JsonToPatch(ops)
+}
+
+func (p Patch) MarshalJSON() ([]byte, error) {
+	return json.Marshal(PatchToJson(p))
+}
+
+func (p Patch) Json(opts ...string) string {
+	ops := PatchToJson(p)
+	var buf []byte
+	switch len(opts) {
+	case 0:
+		buf, _ = json.Marshal(ops)
+	case 1:
+		buf, _ = json.MarshalIndent(ops, "", opts[0])
+	default:
+		buf, _ = json.MarshalIndent(ops, opts[0], opts[1])
+	}
+	return string(buf)
+}
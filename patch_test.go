@@ -0,0 +1,46 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// A changed bytes payload is patched by itself, not by replacing the node
+func TestDiffBytesPayload(t *testing.T) {
+	a := New("Doc").WithAttr("name", "logo").
+		WithSub("owner", New("User").WithAttr("name", "Ada")).
+		WithList([]Meta{New("Item"), New("Item")}).
+		WithBytesPayload([]byte{0, 1, 2}, "image/png")
+
+	for _, b := range []Meta{
+		a.WithBytesPayload([]byte{0, 1, 3}, "image/png"),
+		a.WithBytesPayload([]byte{0, 1, 2}, "image/gif"),
+		a.WithPayload("text"),
+		a.WithoutPayload(),
+		a.WithoutPayload().WithBytesPayload([]byte("\xff"), "application/octet-stream"),
+	} {
+		p := Diff(a, b)
+		if len(p) != 1 || p[0].Path != "/payload" {
+			t.Errorf("%s: got\n%s", CanonicalJson(b), p)
+			continue
+		}
+
+		buf, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		back, err := ParsePatch(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", buf, err)
+		}
+		got, err := back.Apply(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !Equal(got, b) || string(got.PayloadBytes()) != string(b.PayloadBytes()) || got.PayloadType() != b.PayloadType() {
+			t.Errorf("%s applied as %s, want %s", buf, CanonicalJson(got), CanonicalJson(b))
+		}
+	}
+}
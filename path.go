@@ -0,0 +1,419 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Paths address nodes and fields inside a Meta tree:
+//
+//	customer/@account/#3.attr:name
+//
+// Steps are separated by "/": a plain name selects a sub, "@name" a rel and
+// "#index" a list item (negative indexes count from the end). An optional
+// trailing ".attr:name", ".tag:name", ".payload", ".kind", ".method", ".ns"
+// or ".gid" selects a field of the node. The empty path is the root. Use "\"
+// to escape any of "/.@#\" in names.
+
+const (
+	AxisSub  = "sub"
+	AxisRel  = "rel"
+	AxisList = "list"
+)
+
+type PathStep struct {
+	Axis  string // AxisSub, AxisRel or AxisList
+	Name  string
+	Index int
+}
+
+type Path struct {
+	Steps []PathStep
+	Field string // "", "attr", "tag", "payload", "kind", "method", "ns" or "gid"
+	Key   string // attr or tag name
+}
+
+type PathError struct {
+	Path string
+	Pos  int // byte offset into Path
+	Msg  string
+}
+
+func (e *PathError) Error() string {
+	return fmt.Sprintf("Invalid path %q at %d: %s", e.Path, e.Pos, e.Msg)
+}
+
+var pathFields = map[string]bool{
+	"attr": true, "tag": true, "payload": true,
+	"kind": true, "method": true, "ns": true, "gid": true,
+}
+
+func ParsePath(s string) (Path, error) {
+	var p Path
+	pos := 0
+	if strings.HasPrefix(s, "/") {
+		pos = 1
+	}
+
+	for pos < len(s) && s[pos] != '.' {
+		step := PathStep{Axis: AxisSub}
+		switch s[pos] {
+		case '@':
+			step.Axis = AxisRel
+			pos++
+		case '#':
+			step.Axis = AxisList
+			pos++
+		}
+
+		name, end := scanPathName(s, pos)
+		if name == "" {
+			return p, &PathError{s, pos, "missing name"}
+		}
+		if step.Axis == AxisList {
+			idx, err := strconv.Atoi(name)
+			if err != nil {
+				return p, &PathError{s, pos, "invalid list index " + name}
+			}
+			step.Index = idx
+		} else {
+			step.Name = name
+		}
+		p.Steps = append(p.Steps, step)
+		pos = end
+
+		if pos < len(s) && s[pos] == '/' {
+			pos++
+			if pos == len(s) || s[pos] == '.' {
+				return p, &PathError{s, pos, "missing step"}
+			}
+		}
+	}
+
+	if pos < len(s) { // at '.'
+		pos++
+		field := s[pos:]
+		if i := strings.IndexByte(field, ':'); i >= 0 {
+			field = field[:i]
+		}
+		if !pathFields[field] {
+			return p, &PathError{s, pos, "unknown field " + field}
+		}
+		p.Field = field
+		pos += len(field)
+
+		if field == "attr" || field == "tag" {
+			if pos == len(s) {
+				return p, &PathError{s, pos, "missing " + field + " name"}
+			}
+			pos++ // ':'
+			p.Key = s[pos:]
+			if p.Key == "" {
+				return p, &PathError{s, pos, "missing " + field + " name"}
+			}
+		} else if pos < len(s) {
+			return p, &PathError{s, pos, "unexpected " + string(s[pos])}
+		}
+	}
+	return p, nil
+}
+
+func MustParsePath(s string) Path {
+	p, err := ParsePath(s)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// scanPathName reads an escaped name up to the next unescaped "/" or "."
+func scanPathName(s string, pos int) (string, int) {
+	var sb strings.Builder
+	for pos < len(s) {
+		c := s[pos]
+		if c == '/' || c == '.' {
+			break
+		}
+		if c == '\\' && pos+1 < len(s) {
+			pos++
+			c = s[pos]
+		}
+		sb.WriteByte(c)
+		pos++
+	}
+	return sb.String(), pos
+}
+
+func escapePathName(s string) string {
+	if !strings.ContainsAny(s, `/.@#\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '/' || c == '.' || c == '\\' || (i == 0 && (c == '@' || c == '#')) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+func (p Path) String() string {
+	var sb strings.Builder
+	for i, step := range p.Steps {
+		if i > 0 {
+			sb.WriteByte('/')
+		}
+		sb.WriteString(step.String())
+	}
+	if p.Field != "" {
+		sb.WriteByte('.')
+		sb.WriteString(p.Field)
+		if p.Key != "" {
+			sb.WriteByte(':')
+			sb.WriteString(p.Key)
+		}
+	}
+	return sb.String()
+}
+
+func (step PathStep) String() string {
+	switch step.Axis {
+	case AxisRel:
+		return "@" + escapePathName(step.Name)
+	case AxisList:
+		return "#" + strconv.Itoa(step.Index)
+	default:
+		return escapePathName(step.Name)
+	}
+}
+
+// Child returns a copy of p extended with step, without any field.
+func (p Path) Child(step PathStep) Path {
+	steps := make([]PathStep, len(p.Steps), len(p.Steps)+1)
+	copy(steps, p.Steps)
+	return Path{Steps: append(steps, step)}
+}
+
+// Parent returns p without its field, or without its last step if no field.
+func (p Path) Parent() Path {
+	if p.Field != "" {
+		return Path{Steps: p.Steps}
+	}
+	if len(p.Steps) == 0 {
+		return p
+	}
+	return Path{Steps: p.Steps[:len(p.Steps)-1]}
+}
+
+func (p Path) IsRoot() bool {
+	return len(p.Steps) == 0 && p.Field == ""
+}
+
+// navigation
+
+func (step PathStep) From(m Meta) Meta {
+	switch step.Axis {
+	case AxisRel:
+		return m.Rel(step.Name)
+	case AxisList:
+		return m.ListItem(listIndex(m, step.Index))
+	default:
+		return m.Sub(step.Name)
+	}
+}
+
+func listIndex(m Meta, idx int) int {
+	if idx < 0 {
+		idx += len(m.List())
+	}
+	return idx
+}
+
+// Node returns the node p addresses (ignoring any field), or Nil.
+func (p Path) Node(m Meta) Meta {
+	m = orNil(m)
+	for _, step := range p.Steps {
+		if m = step.From(m); m.IsNil() {
+			return Nil
+		}
+	}
+	return m
+}
+
+// Value returns the field p addresses, or "" if missing.
+func (p Path) Value(m Meta) string {
+	n := p.Node(m)
+	switch p.Field {
+	case "attr":
+		return n.Attr(p.Key)
+	case "tag":
+		return n.Tag(p.Key)
+	case "payload":
+		return n.Payload()
+	case "kind":
+		return n.Kind()
+	case "method":
+		return n.Method()
+	case "ns":
+		return n.Ns()
+	case "gid":
+		return n.Gid()
+	}
+	return ""
+}
+
+// Update replaces the node p addresses with fn(node) and rebuilds only the
+// nodes along the path. fn receives Nil for a missing node; returning Nil
+// removes it. Intermediate nodes must exist.
+func (p Path) Update(m Meta, fn func(Meta) Meta) (Meta, error) {
+	if p.Field != "" {
+		return m, fmt.Errorf("Path %s addresses a field", p)
+	}
+	return updatePath(orNil(m), p, 0, fn)
+}
+
+func updatePath(m Meta, p Path, i int, fn func(Meta) Meta) (Meta, error) {
+	if i == len(p.Steps) {
+		return orNil(fn(m)), nil
+	}
+	if m.IsNil() {
+		return m, fmt.Errorf("Path %s: missing node at %s", p, Path{Steps: p.Steps[:i]})
+	}
+
+	step := p.Steps[i]
+	if step.Axis == AxisList {
+		idx := listIndex(m, step.Index)
+		if n := len(m.List()); idx < 0 || idx > n || idx == n && i+1 < len(p.Steps) {
+			return m, fmt.Errorf("Path %s: list index %d out of range", p, step.Index)
+		}
+	}
+
+	child, err := updatePath(step.From(m), p, i+1, fn)
+	if err != nil {
+		return m, err
+	}
+
+	switch step.Axis {
+	case AxisRel:
+		if child.IsNil() {
+			return m.WithoutRel(step.Name), nil
+		}
+		return m.WithRel(step.Name, child), nil
+	case AxisList:
+		idx := listIndex(m, step.Index)
+		if idx == len(m.List()) {
+			if child.IsNil() {
+				return m, nil
+			}
+			return m.WithList(append(append([]Meta{}, m.List()...), child), false), nil
+		}
+		if child.IsNil() {
+			return m.WithoutListItem(idx), nil
+		}
+		return m.WithListItem(idx, child), nil
+	default:
+		if child.IsNil() {
+			return m.WithoutSub(step.Name), nil
+		}
+		return m.WithSub(step.Name, child), nil
+	}
+}
+
+// SetValue sets the attr, tag, payload, method or gid p addresses.
+func (p Path) SetValue(m Meta, value string) (Meta, error) {
+	node := Path{Steps: p.Steps}
+	var err error
+	ret, _ := node.Update(m, func(n Meta) Meta {
+		if n.IsNil() {
+			err = fmt.Errorf("Path %s: missing node", p)
+			return n
+		}
+		switch p.Field {
+		case "attr":
+			return n.WithAttr(p.Key, value)
+		case "tag":
+			return n.WithTag(p.Key, value)
+		case "payload":
+			return n.WithPayload(value)
+		case "method":
+			return n.WithMethod(value)
+		case "gid":
+			return n.WithGid(value)
+		case "":
+			err = fmt.Errorf("Path %s addresses a node", p)
+		default:
+			err = fmt.Errorf("Path %s: field %s is read-only", p, p.Field)
+		}
+		return n
+	})
+	if err != nil {
+		return m, err
+	}
+	return ret, nil
+}
+
+// Get returns what path addresses: the node, or Nil if missing, or for a
+// field path like "customer/@account/#3.attr:name" the field as a string,
+// or "" if missing. Use GetNode and GetValue to get a typed result.
+func Get(m Meta, path string) (interface{}, error) {
+	p, err := ParsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	if p.Field != "" {
+		return p.Value(m), nil
+	}
+	return p.Node(m), nil
+}
+
+// GetNode returns the node at path, or Nil if missing.
+func GetNode(m Meta, path string) (Meta, error) {
+	p, err := ParsePath(path)
+	if err != nil {
+		return Nil, err
+	}
+	if p.Field != "" {
+		return Nil, fmt.Errorf("Path %s addresses a field, use GetValue", path)
+	}
+	return p.Node(m), nil
+}
+
+// GetValue returns the field at path, e.g. "customer.attr:name".
+func GetValue(m Meta, path string) (string, error) {
+	p, err := ParsePath(path)
+	if err != nil {
+		return "", err
+	}
+	if p.Field == "" {
+		return "", fmt.Errorf("Path %s addresses a node, use GetNode", path)
+	}
+	return p.Value(m), nil
+}
+
+// Set replaces the node at path with value; Nil removes it. Nodes along
+// the path must exist.
+func Set(m Meta, path string, value Meta) (Meta, error) {
+	return Update(m, path, func(Meta) Meta { return value })
+}
+
+// SetValue sets the field at path, e.g. "customer.attr:name".
+func SetValue(m Meta, path, value string) (Meta, error) {
+	p, err := ParsePath(path)
+	if err != nil {
+		return m, err
+	}
+	return p.SetValue(m, value)
+}
+
+// Update replaces the node at path with fn applied to it.
+func Update(m Meta, path string, fn func(Meta) Meta) (Meta, error) {
+	p, err := ParsePath(path)
+	if err != nil {
+		return m, err
+	}
+	return p.Update(m, fn)
+}
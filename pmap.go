@@ -0,0 +1,375 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// pmap is a persistent string-keyed map. Small maps are kept as a sorted
+// slice, copied on write; larger ones as a hash array mapped trie (HAMT), so
+// that Set and Delete copy only O(log32 n) nodes and share the rest. The
+// zero value is an empty map.
+type pmap[V any] struct {
+	small []pentry[V] // sorted by key, when root is nil
+	root  *hnode[V]
+	size  int
+}
+
+type strMap = pmap[string]
+type metaMap = pmap[Meta]
+
+type pentry[V any] struct {
+	key string
+	val V
+}
+
+const (
+	pmapSmall = 8
+	hbits     = 5
+	hmask     = 1<<hbits - 1
+)
+
+// hnode is a trie node: slots are either leaves or children, indexed by
+// bitmap. Past the last level (shift >= 32) a node is a plain list of the
+// colliding leaves.
+type hnode[V any] struct {
+	bitmap uint32
+	slots  []hslot[V]
+}
+
+type hslot[V any] struct {
+	pentry[V]
+	child *hnode[V]
+}
+
+func hashKey(s string) uint32 { // FNV-1a
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// pmapOf builds a pmap from vals in one pass.
+func pmapOf[V any](vals map[string]V) pmap[V] {
+	n := len(vals)
+	if n <= pmapSmall {
+		small := make([]pentry[V], 0, n)
+		for k, v := range vals {
+			small = append(small, pentry[V]{k, v})
+		}
+		sort.Slice(small, func(i, j int) bool { return small[i].key < small[j].key })
+		return pmap[V]{small: small, size: n}
+	}
+
+	root := &hnode[V]{}
+	for k, v := range vals {
+		root.insert(hashKey(k), 0, k, v)
+	}
+	return pmap[V]{root: root, size: n}
+}
+
+// pmapSorted builds a pmap from entries sorted by key, without duplicates,
+// taking over the slice.
+func pmapSorted[V any](entries []pentry[V]) pmap[V] {
+	n := len(entries)
+	if n <= pmapSmall {
+		return pmap[V]{small: entries, size: n}
+	}
+
+	root := &hnode[V]{}
+	for _, e := range entries {
+		root.insert(hashKey(e.key), 0, e.key, e.val)
+	}
+	return pmap[V]{root: root, size: n}
+}
+
+func (pm pmap[V]) Len() int {
+	return pm.size
+}
+
+func (pm pmap[V]) Get(key string) (V, bool) {
+	if pm.root == nil {
+		i := sort.Search(len(pm.small), func(i int) bool { return pm.small[i].key >= key })
+		if i < len(pm.small) && pm.small[i].key == key {
+			return pm.small[i].val, true
+		}
+		var zero V
+		return zero, false
+	}
+	return pm.root.get(hashKey(key), 0, key)
+}
+
+// At returns the value of key, or the zero value.
+func (pm pmap[V]) At(key string) V {
+	val, _ := pm.Get(key)
+	return val
+}
+
+func (pm pmap[V]) Has(key string) bool {
+	_, ok := pm.Get(key)
+	return ok
+}
+
+// Set returns a map with key set to val; pm is unchanged.
+func (pm pmap[V]) Set(key string, val V) pmap[V] {
+	if pm.root == nil {
+		i := sort.Search(len(pm.small), func(i int) bool { return pm.small[i].key >= key })
+		if i < len(pm.small) && pm.small[i].key == key {
+			small := append([]pentry[V]{}, pm.small...)
+			small[i].val = val
+			return pmap[V]{small: small, size: pm.size}
+		}
+		if pm.size < pmapSmall {
+			small := make([]pentry[V], 0, pm.size+1)
+			small = append(small, pm.small[:i]...)
+			small = append(small, pentry[V]{key, val})
+			small = append(small, pm.small[i:]...)
+			return pmap[V]{small: small, size: pm.size + 1}
+		}
+
+		root := &hnode[V]{}
+		for _, e := range pm.small {
+			root.insert(hashKey(e.key), 0, e.key, e.val)
+		}
+		root.insert(hashKey(key), 0, key, val)
+		return pmap[V]{root: root, size: pm.size + 1}
+	}
+
+	root, added := pm.root.set(hashKey(key), 0, key, val)
+	size := pm.size
+	if added {
+		size++
+	}
+	return pmap[V]{root: root, size: size}
+}
+
+// Delete returns a map without key, or pm itself if key is absent.
+func (pm pmap[V]) Delete(key string) pmap[V] {
+	if !pm.Has(key) {
+		return pm
+	}
+	if pm.root == nil {
+		small := make([]pentry[V], 0, pm.size-1)
+		for _, e := range pm.small {
+			if e.key != key {
+				small = append(small, e)
+			}
+		}
+		return pmap[V]{small: small, size: pm.size - 1}
+	}
+
+	if pm.size-1 <= pmapSmall/2 { // back to small
+		small := make([]pentry[V], 0, pm.size-1)
+		pm.Range(func(k string, v V) bool {
+			if k != key {
+				small = append(small, pentry[V]{k, v})
+			}
+			return true
+		})
+		sort.Slice(small, func(i, j int) bool { return small[i].key < small[j].key })
+		return pmap[V]{small: small, size: pm.size - 1}
+	}
+	return pmap[V]{root: pm.root.delete(hashKey(key), 0, key), size: pm.size - 1}
+}
+
+// Range calls fn for each entry, in no particular order, until fn returns false.
+func (pm pmap[V]) Range(fn func(key string, val V) bool) {
+	if pm.root == nil {
+		for _, e := range pm.small {
+			if !fn(e.key, e.val) {
+				return
+			}
+		}
+		return
+	}
+	pm.root.each(fn)
+}
+
+// Keys returns the keys sorted.
+func (pm pmap[V]) Keys() []string {
+	keys := make([]string, 0, pm.size)
+	pm.Range(func(k string, _ V) bool {
+		keys = append(keys, k)
+		return true
+	})
+	if pm.root != nil {
+		sort.Strings(keys)
+	}
+	return keys
+}
+
+func (pm pmap[V]) Map() map[string]V {
+	ret := make(map[string]V, pm.size)
+	pm.Range(func(k string, v V) bool {
+		ret[k] = v
+		return true
+	})
+	return ret
+}
+
+// trie
+
+func (n *hnode[V]) index(bit uint32) int {
+	return bits.OnesCount32(n.bitmap & (bit - 1))
+}
+
+func (n *hnode[V]) get(h uint32, shift uint, key string) (V, bool) {
+	for {
+		if shift >= 32 {
+			for _, s := range n.slots {
+				if s.key == key {
+					return s.val, true
+				}
+			}
+			break
+		}
+		bit := uint32(1) << ((h >> shift) & hmask)
+		if n.bitmap&bit == 0 {
+			break
+		}
+		s := n.slots[n.index(bit)]
+		if s.child == nil {
+			if s.key == key {
+				return s.val, true
+			}
+			break
+		}
+		n, shift = s.child, shift+hbits
+	}
+	var zero V
+	return zero, false
+}
+
+// insert mutates n in place; only for nodes not yet shared
+func (n *hnode[V]) insert(h uint32, shift uint, key string, val V) {
+	if shift >= 32 {
+		for i := range n.slots {
+			if n.slots[i].key == key {
+				n.slots[i].val = val
+				return
+			}
+		}
+		n.slots = append(n.slots, hslot[V]{pentry: pentry[V]{key, val}})
+		return
+	}
+
+	bit := uint32(1) << ((h >> shift) & hmask)
+	idx := n.index(bit)
+	if n.bitmap&bit == 0 {
+		n.slots = append(n.slots, hslot[V]{})
+		copy(n.slots[idx+1:], n.slots[idx:])
+		n.slots[idx] = hslot[V]{pentry: pentry[V]{key, val}}
+		n.bitmap |= bit
+		return
+	}
+
+	s := &n.slots[idx]
+	switch {
+	case s.child != nil:
+		s.child.insert(h, shift+hbits, key, val)
+	case s.key == key:
+		s.val = val
+	default:
+		child := &hnode[V]{}
+		child.insert(hashKey(s.key), shift+hbits, s.key, s.val)
+		child.insert(h, shift+hbits, key, val)
+		*s = hslot[V]{child: child}
+	}
+}
+
+// set returns a copy of n with key set, sharing untouched children
+func (n *hnode[V]) set(h uint32, shift uint, key string, val V) (*hnode[V], bool) {
+	ret := &hnode[V]{n.bitmap, append(make([]hslot[V], 0, len(n.slots)+1), n.slots...)}
+	if shift >= 32 {
+		for i := range ret.slots {
+			if ret.slots[i].key == key {
+				ret.slots[i].val = val
+				return ret, false
+			}
+		}
+		ret.slots = append(ret.slots, hslot[V]{pentry: pentry[V]{key, val}})
+		return ret, true
+	}
+
+	bit := uint32(1) << ((h >> shift) & hmask)
+	idx := n.index(bit)
+	if n.bitmap&bit == 0 {
+		ret.insert(h, shift, key, val)
+		return ret, true
+	}
+
+	s := &ret.slots[idx]
+	switch {
+	case s.child != nil:
+		child, added := s.child.set(h, shift+hbits, key, val)
+		s.child = child
+		return ret, added
+	case s.key == key:
+		s.val = val
+		return ret, false
+	default:
+		child := &hnode[V]{}
+		child.insert(hashKey(s.key), shift+hbits, s.key, s.val)
+		child.insert(h, shift+hbits, key, val)
+		*s = hslot[V]{child: child}
+		return ret, true
+	}
+}
+
+// delete returns a copy of n without key, which must be present; nil if empty
+func (n *hnode[V]) delete(h uint32, shift uint, key string) *hnode[V] {
+	if shift >= 32 {
+		ret := &hnode[V]{}
+		for _, s := range n.slots {
+			if s.key != key {
+				ret.slots = append(ret.slots, s)
+			}
+		}
+		if len(ret.slots) == 0 {
+			return nil
+		}
+		return ret
+	}
+
+	bit := uint32(1) << ((h >> shift) & hmask)
+	idx := n.index(bit)
+	s := n.slots[idx]
+	if s.child != nil {
+		child := s.child.delete(h, shift+hbits, key)
+		if child != nil {
+			if len(child.slots) == 1 && child.slots[0].child == nil { // pull the leaf up
+				s = child.slots[0]
+			} else {
+				s = hslot[V]{child: child}
+			}
+			ret := &hnode[V]{n.bitmap, append([]hslot[V]{}, n.slots...)}
+			ret.slots[idx] = s
+			return ret
+		}
+	}
+
+	if len(n.slots) == 1 {
+		return nil
+	}
+	ret := &hnode[V]{n.bitmap &^ bit, make([]hslot[V], 0, len(n.slots)-1)}
+	ret.slots = append(ret.slots, n.slots[:idx]...)
+	ret.slots = append(ret.slots, n.slots[idx+1:]...)
+	return ret
+}
+
+func (n *hnode[V]) each(fn func(string, V) bool) bool {
+	for _, s := range n.slots {
+		if s.child != nil {
+			if !s.child.each(fn) {
+				return false
+			}
+		} else if !fn(s.key, s.val) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// The benchmarks build Metas of N attrs and report the time per attr, which
+// stays about flat as N grows with the persistent maps, while copying the
+// map on each write, as Meta did before, grows linearly with N.
+
+var benchSizes = []int{10, 1000, 5000}
+
+func benchNames(n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = "attr" + strconv.Itoa(i)
+	}
+	return names
+}
+
+func benchSizesRun(b *testing.B, fn func(b *testing.B, names []string)) {
+	for _, n := range benchSizes {
+		names := benchNames(n)
+		b.Run("N="+strconv.Itoa(n), func(b *testing.B) {
+			b.ReportAllocs()
+			start := time.Now()
+			fn(b, names)
+			b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(b.N*len(names)), "ns/attr")
+		})
+	}
+}
+
+func BenchmarkWithAttr(b *testing.B) {
+	benchSizesRun(b, func(b *testing.B, names []string) {
+		for i := 0; i < b.N; i++ {
+			m := New("Config")
+			for _, name := range names {
+				m = m.WithAttr(name, name)
+			}
+		}
+	})
+}
+
+func BenchmarkBuilderSetAttr(b *testing.B) {
+	benchSizesRun(b, func(b *testing.B, names []string) {
+		for i := 0; i < b.N; i++ {
+			bd := NewBuilder("Config")
+			for _, name := range names {
+				bd.SetAttr(name, name)
+			}
+			bd.Build()
+		}
+	})
+}
+
+// BenchmarkCopyMap is the previous copy-on-write scheme, for comparison
+func BenchmarkCopyMap(b *testing.B) {
+	benchSizesRun(b, func(b *testing.B, names []string) {
+		for i := 0; i < b.N; i++ {
+			attrs := map[string]string{}
+			for _, name := range names {
+				next := make(map[string]string, len(attrs)+1)
+				for k, v := range attrs {
+					next[k] = v
+				}
+				next[name] = name
+				attrs = next
+			}
+		}
+	})
+}
@@ -0,0 +1,564 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Queries select nodes of a Meta tree, in the spirit of XPath:
+//
+//	//[Customer][attr:age>=18]/@account
+//	/[kind=Order]/#*[tag:status!=done], //[shop:Item]
+//
+// A query is a comma-separated union of paths. Steps are separated by "/"
+// (children) or "//" (descendant-or-self at any depth). A step selects
+//
+//	name   the sub name      *   any sub
+//	@name  the rel name      @*  any rel
+//	#n     the list item n   #*  any list item
+//	~      any child         .   the node itself (also when omitted)
+//
+// followed by predicates in brackets, all of which must hold:
+//
+//	[Kind] [ns:Kind]               kind (and ns) shorthand
+//	[kind=v] [ns=v] [method=v] [gid=v] [payload=v]
+//	[tag:name] [attr:name]         presence
+//	[tag:name=v] [attr:name>3]     comparison (!= also holds when missing)
+//	[sub:name] [rel:name=Kind]     presence, or kind of the sub/rel
+//	[!pred]                        negation
+//
+// Operators are = != ^= (prefix) $= (suffix) *= (contains) and < <= > >=,
+// which compare numerically when both sides are numbers. Values may be
+// double-quoted.
+
+type QueryError struct {
+	Query string
+	Pos   int // byte offset into Query
+	Msg   string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("Invalid query %q at %d: %s", e.Query, e.Pos, e.Msg)
+}
+
+type Selector struct {
+	src   string
+	paths [][]queryStep
+}
+
+type queryStep struct {
+	desc  bool   // preceded by "//"
+	axis  string // AxisSub, AxisRel, AxisList, "" for self, "~" for any child
+	name  string // "*" for any
+	index int
+	preds []queryPred
+}
+
+type queryPred struct {
+	not   bool
+	field string // kind, ns, method, gid, payload, tag, attr, sub, rel
+	key   string
+	op    string // "" for presence
+	value string
+	also  *queryPred // for the [ns:Kind] shorthand
+}
+
+func CompileSelector(expr string) (*Selector, error) {
+	qp := &queryParser{src: expr}
+	sel := &Selector{src: expr}
+	for {
+		path, err := qp.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		sel.paths = append(sel.paths, path)
+
+		qp.skipSpaces()
+		if qp.eof() {
+			return sel, nil
+		}
+		if qp.peek() != ',' {
+			return nil, qp.errorf("unexpected %c", qp.peek())
+		}
+		qp.pos++
+	}
+}
+
+func MustCompileSelector(expr string) *Selector {
+	sel, err := CompileSelector(expr)
+	if err != nil {
+		panic(err)
+	}
+	return sel
+}
+
+func (sel *Selector) String() string {
+	return sel.src
+}
+
+// Select returns the matching nodes of m in document order, without
+// duplicates. Nodes are told apart by position, so the same Meta shared at
+// two places is selected twice.
+func (sel *Selector) Select(m Meta) []Meta {
+	var ret []Meta
+	seen := map[string]bool{}
+	for _, path := range sel.paths {
+		for _, n := range selectPath(orNil(m), path) {
+			if !seen[n.path] {
+				seen[n.path] = true
+				ret = append(ret, n.m)
+			}
+		}
+	}
+	return ret
+}
+
+// First returns the first match, or Nil.
+func (sel *Selector) First(m Meta) Meta {
+	return First(sel.Select(m))
+}
+
+func (sel *Selector) Matches(m Meta) bool {
+	return len(sel.Select(m)) > 0
+}
+
+func Query(m Meta, expr string) ([]Meta, error) {
+	sel, err := CompileSelector(expr)
+	if err != nil {
+		return nil, err
+	}
+	return sel.Select(m), nil
+}
+
+func QueryFirst(m Meta, expr string) (Meta, error) {
+	sel, err := CompileSelector(expr)
+	if err != nil {
+		return Nil, err
+	}
+	return sel.First(m), nil
+}
+
+// evaluation
+
+// queryNode is a node with its path from the root, which identifies it
+type queryNode struct {
+	m    Meta
+	path string
+}
+
+func (n queryNode) child(m Meta, step PathStep) queryNode {
+	return queryNode{m, n.path + "/" + step.String()}
+}
+
+func selectPath(root Meta, path []queryStep) []queryNode {
+	ctx := []queryNode{{root, ""}}
+	for _, step := range path {
+		var next []queryNode
+		seen := map[string]bool{}
+		for _, n := range ctx {
+			srcs := []queryNode{n}
+			if step.desc {
+				srcs = descendants(n, nil)
+			}
+			for _, src := range srcs {
+				for _, c := range step.candidates(src) {
+					if !seen[c.path] && !c.m.IsNil() && step.matches(c.m) {
+						seen[c.path] = true
+						next = append(next, c)
+					}
+				}
+			}
+		}
+		ctx = next
+	}
+	return ctx
+}
+
+// descendants appends n and all nodes below it in document order
+func descendants(n queryNode, acc []queryNode) []queryNode {
+	if IsNil(n.m) {
+		return acc
+	}
+	acc = append(acc, n)
+	for _, c := range children(n) {
+		acc = descendants(c, acc)
+	}
+	return acc
+}
+
+// children returns the subs, rels and list items of n in document order
+func children(n queryNode) []queryNode {
+	m := n.m
+	ret := make([]queryNode, 0, m.SubCount()+m.RelCount()+len(m.List()))
+	ret = appendSubs(ret, n, AxisSub, m.SubNames(), m.Sub)
+	ret = appendSubs(ret, n, AxisRel, m.RelNames(), m.Rel)
+	return appendItems(ret, n)
+}
+
+func appendSubs(acc []queryNode, n queryNode, axis string, names []string, get func(string) Meta) []queryNode {
+	for _, name := range names {
+		acc = append(acc, n.child(get(name), PathStep{Axis: axis, Name: name}))
+	}
+	return acc
+}
+
+func appendItems(acc []queryNode, n queryNode) []queryNode {
+	for i, item := range n.m.List() {
+		acc = append(acc, n.child(item, PathStep{Axis: AxisList, Index: i}))
+	}
+	return acc
+}
+
+func (step queryStep) candidates(n queryNode) []queryNode {
+	m := n.m
+	switch step.axis {
+	case "":
+		return []queryNode{n}
+	case "~":
+		return children(n)
+	case AxisSub:
+		if step.name != "*" {
+			return []queryNode{n.child(m.Sub(step.name), PathStep{Axis: AxisSub, Name: step.name})}
+		}
+		return appendSubs(nil, n, AxisSub, m.SubNames(), m.Sub)
+	case AxisRel:
+		if step.name != "*" {
+			return []queryNode{n.child(m.Rel(step.name), PathStep{Axis: AxisRel, Name: step.name})}
+		}
+		return appendSubs(nil, n, AxisRel, m.RelNames(), m.Rel)
+	case AxisList:
+		if step.name != "*" {
+			idx := listIndex(m, step.index)
+			return []queryNode{n.child(m.ListItem(idx), PathStep{Axis: AxisList, Index: idx})}
+		}
+		return appendItems(nil, n)
+	}
+	return nil
+}
+
+func (step queryStep) matches(m Meta) bool {
+	for _, pred := range step.preds {
+		if !pred.matches(m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (pred queryPred) matches(m Meta) bool {
+	ok := pred.test(m)
+	if ok && pred.also != nil {
+		ok = pred.also.test(m)
+	}
+	return ok != pred.not
+}
+
+func (pred queryPred) test(m Meta) bool {
+	var val string
+	switch pred.field {
+	case "kind":
+		val = m.Kind()
+	case "ns":
+		val = m.Ns()
+	case "method":
+		val = m.Method()
+	case "gid":
+		val = m.Gid()
+	case "payload":
+		val = m.Payload()
+	case "tag":
+		if !m.HasTag(pred.key) {
+			return pred.op == "!="
+		}
+		val = m.Tag(pred.key)
+	case "attr":
+		var ok bool
+		if val, ok = m.AttrOk(pred.key); !ok {
+			return pred.op == "!="
+		}
+	case "sub", "rel":
+		n := m.Sub(pred.key)
+		if pred.field == "rel" {
+			n = m.Rel(pred.key)
+		}
+		if n.IsNil() {
+			return false
+		}
+		val = n.Kind()
+	}
+	if pred.op == "" {
+		return true
+	}
+	return compareOp(val, pred.op, pred.value)
+}
+
+func compareOp(a, op, b string) bool {
+	switch op {
+	case "=":
+		return a == b
+	case "!=":
+		return a != b
+	case "^=":
+		return strings.HasPrefix(a, b)
+	case "$=":
+		return strings.HasSuffix(a, b)
+	case "*=":
+		return strings.Contains(a, b)
+	}
+
+	c := strings.Compare(a, b)
+	if x, err := strconv.ParseFloat(a, 64); err == nil {
+		if y, err := strconv.ParseFloat(b, 64); err == nil {
+			c = 0
+			if x < y {
+				c = -1
+			} else if x > y {
+				c = 1
+			}
+		}
+	}
+	switch op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// parsing
+
+type queryParser struct {
+	src string
+	pos int
+}
+
+var queryFields = map[string]bool{
+	"kind": true, "ns": true, "method": true, "gid": true, "payload": true,
+}
+
+var queryKeyFields = map[string]bool{
+	"tag": true, "attr": true, "sub": true, "rel": true,
+}
+
+func (qp *queryParser) eof() bool {
+	return qp.pos >= len(qp.src)
+}
+
+func (qp *queryParser) peek() byte {
+	return qp.src[qp.pos]
+}
+
+func (qp *queryParser) errorf(format string, args ...interface{}) error {
+	return &QueryError{qp.src, qp.pos, fmt.Sprintf(format, args...)}
+}
+
+func (qp *queryParser) skipSpaces() {
+	for !qp.eof() && (qp.peek() == ' ' || qp.peek() == '\t') {
+		qp.pos++
+	}
+}
+
+func (qp *queryParser) parsePath() ([]queryStep, error) {
+	var path []queryStep
+	qp.skipSpaces()
+	desc := false
+	if strings.HasPrefix(qp.src[qp.pos:], "//") {
+		desc, qp.pos = true, qp.pos+2
+	} else if !qp.eof() && qp.peek() == '/' {
+		qp.pos++
+	}
+
+	for {
+		step, err := qp.parseStep(desc)
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, step)
+
+		if strings.HasPrefix(qp.src[qp.pos:], "//") {
+			desc, qp.pos = true, qp.pos+2
+		} else if !qp.eof() && qp.peek() == '/' {
+			desc, qp.pos = false, qp.pos+1
+		} else {
+			return path, nil
+		}
+	}
+}
+
+func (qp *queryParser) parseStep(desc bool) (queryStep, error) {
+	step := queryStep{desc: desc}
+	start := qp.pos
+	if !qp.eof() {
+		switch c := qp.peek(); c {
+		case '.', '~':
+			qp.pos++
+			if c == '~' {
+				step.axis = "~"
+			}
+		case '*':
+			qp.pos++
+			step.axis, step.name = AxisSub, "*"
+		case '@', '#':
+			qp.pos++
+			step.axis = AxisRel
+			if c == '#' {
+				step.axis = AxisList
+			}
+			name := qp.scanName()
+			if name == "" {
+				return step, qp.errorf("missing name")
+			}
+			if c == '#' && name != "*" {
+				idx, err := strconv.Atoi(name)
+				if err != nil {
+					return step, &QueryError{qp.src, start + 1, "invalid list index " + name}
+				}
+				step.index = idx
+			}
+			step.name = name
+		case '[', '/', ',':
+		default:
+			step.axis, step.name = AxisSub, qp.scanName()
+			if step.name == "" {
+				return step, qp.errorf("unexpected %c", c)
+			}
+		}
+	}
+
+	for !qp.eof() && qp.peek() == '[' {
+		qp.pos++
+		pred, err := qp.parsePred()
+		if err != nil {
+			return step, err
+		}
+		step.preds = append(step.preds, pred)
+	}
+
+	if step.axis == "" && len(step.preds) == 0 && qp.pos == start && !desc {
+		return step, qp.errorf("missing step")
+	}
+	return step, nil
+}
+
+// scanName reads an escaped name up to the next delimiter
+func (qp *queryParser) scanName() string {
+	var sb strings.Builder
+	for !qp.eof() {
+		c := qp.peek()
+		if strings.IndexByte("/[],!=<>^$*~: \t", c) >= 0 && !(c == '*' && sb.Len() == 0) {
+			break
+		}
+		if c == '\\' && qp.pos+1 < len(qp.src) {
+			qp.pos++
+			c = qp.peek()
+		}
+		sb.WriteByte(c)
+		qp.pos++
+		if c == '*' && sb.Len() == 1 {
+			break
+		}
+	}
+	return sb.String()
+}
+
+func (qp *queryParser) parsePred() (queryPred, error) {
+	var pred queryPred
+	qp.skipSpaces()
+	if !qp.eof() && qp.peek() == '!' {
+		pred.not = true
+		qp.pos++
+		qp.skipSpaces()
+	}
+
+	start := qp.pos
+	word := qp.scanName()
+	if word == "" {
+		return pred, qp.errorf("missing predicate")
+	}
+
+	if !qp.eof() && qp.peek() == ':' {
+		qp.pos++
+		key := qp.scanName()
+		if key == "" {
+			return pred, qp.errorf("missing name")
+		}
+		if queryKeyFields[word] {
+			pred.field, pred.key = word, key
+		} else { // [ns:Kind]
+			pred.field, pred.op, pred.value = "ns", "=", word
+			pred.also = &queryPred{field: "kind", op: "=", value: key}
+		}
+	} else if queryFields[word] {
+		pred.field = word
+	} else { // [Kind]
+		pred.field, pred.op, pred.value = "kind", "=", word
+	}
+
+	qp.skipSpaces()
+	if pred.op == "" {
+		op := qp.scanOp()
+		if op == "" && queryFields[pred.field] {
+			return pred, &QueryError{qp.src, start, "missing operator for " + pred.field}
+		}
+		if op != "" {
+			qp.skipSpaces()
+			val, err := qp.scanValue()
+			if err != nil {
+				return pred, err
+			}
+			pred.op, pred.value = op, val
+		}
+	}
+
+	qp.skipSpaces()
+	if qp.eof() || qp.peek() != ']' {
+		return pred, qp.errorf("missing ]")
+	}
+	qp.pos++
+	return pred, nil
+}
+
+func (qp *queryParser) scanOp() string {
+	for _, op := range []string{"!=", "^=", "$=", "*=", "<=", ">=", "=", "<", ">"} {
+		if strings.HasPrefix(qp.src[qp.pos:], op) {
+			qp.pos += len(op)
+			return op
+		}
+	}
+	return ""
+}
+
+func (qp *queryParser) scanValue() (string, error) {
+	if !qp.eof() && qp.peek() == '"' {
+		start := qp.pos
+		for i := qp.pos + 1; i < len(qp.src); i++ {
+			if qp.src[i] == '\\' {
+				i++
+			} else if qp.src[i] == '"' {
+				val, err := strconv.Unquote(qp.src[start : i+1])
+				if err != nil {
+					return "", &QueryError{qp.src, start, "invalid string"}
+				}
+				qp.pos = i + 1
+				return val, nil
+			}
+		}
+		return "", &QueryError{qp.src, start, "unterminated string"}
+	}
+
+	end := strings.IndexByte(qp.src[qp.pos:], ']')
+	if end < 0 {
+		return "", qp.errorf("missing ]")
+	}
+	val := strings.TrimSpace(qp.src[qp.pos : qp.pos+end])
+	qp.pos += end
+	return val, nil
+}
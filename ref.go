@@ -0,0 +1,171 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"context"
+	"fmt"
+)
+
+// A Ref stands for another Meta by gid, so that rels can form graphs (even
+// cycles) without embedding copies. The target kind is kept in tag "kind".
+const RefKind = "Ref"
+
+func Ref(target Meta) Meta {
+	return RefTo(target.Kind(), target.Ns(), target.Gid())
+}
+
+func RefTo(kind, ns, gid string) Meta {
+	ret := New(RefKind, "", ns, gid)
+	if kind != "" {
+		ret = ret.WithTag("kind", kind)
+	}
+	return ret
+}
+
+func IsRef(m Meta) bool {
+	return m != nil && m.Kind() == RefKind && m.Gid() != ""
+}
+
+type Resolver interface {
+	Resolve(ctx context.Context, ref Meta) (Meta, error)
+}
+
+type ResolverFunc func(ctx context.Context, ref Meta) (Meta, error)
+
+func (fn ResolverFunc) Resolve(ctx context.Context, ref Meta) (Meta, error) {
+	return fn(ctx, ref)
+}
+
+// MapResolver looks refs up by gid.
+type MapResolver map[string]Meta
+
+func (r MapResolver) Resolve(ctx context.Context, ref Meta) (Meta, error) {
+	if m, ok := r[ref.Gid()]; ok {
+		return m, nil
+	}
+	return Nil, fmt.Errorf("Ref %s not found", ref.Gid())
+}
+
+// IndexerResolver resolves refs to the Meta of the actor with the same gid.
+func IndexerResolver(idx Indexer) Resolver {
+	return ResolverFunc(func(ctx context.Context, ref Meta) (Meta, error) {
+		if actor := idx.ActorWithGid(ref.Gid()); actor != nil {
+			return actor.Meta(), nil
+		}
+		return Nil, fmt.Errorf("Actor %s not found", ref.Gid())
+	})
+}
+
+// MpiResolver resolves refs by calling "find" on a Meta of the target kind
+// carrying the gid.
+func MpiResolver(mpi Mpi) Resolver {
+	return ResolverFunc(func(ctx context.Context, ref Meta) (Meta, error) {
+		return mpi.Call(ctx, "find", New(ref.Tag("kind"), "", ref.Ns(), ref.Gid()))
+	})
+}
+
+// Resolve replaces the refs in m, transitively, with what r returns. A ref
+// to a node already being resolved on the current path is left in place, so
+// cyclic graphs come back as finite trees. Each gid is looked up and
+// resolved once, and a Meta shared at several places is resolved once, so
+// the result for a shared target is reused even where it left a ref in
+// place to cut a cycle.
+func Resolve(ctx context.Context, m Meta, r Resolver) (Meta, error) {
+	res := &refResolver{r, map[string]Meta{}, map[Meta]Meta{}, map[string]bool{}}
+	return res.resolve(ctx, orNil(m))
+}
+
+type refResolver struct {
+	r      Resolver
+	refs   map[string]Meta // resolved targets by gid
+	nodes  map[Meta]Meta   // resolved nodes
+	active map[string]bool // gids being resolved on the current path
+}
+
+func (res *refResolver) resolve(ctx context.Context, m Meta) (Meta, error) {
+	if IsRef(m) {
+		gid := m.Gid()
+		if res.active[gid] {
+			return m, nil
+		}
+		if ret, ok := res.refs[gid]; ok {
+			return ret, nil
+		}
+		target, err := res.r.Resolve(ctx, m)
+		if err != nil {
+			return m, err
+		}
+		ret, err := res.resolve(ctx, orNil(target))
+		if err != nil {
+			return m, err
+		}
+		res.refs[gid] = ret
+		return ret, nil
+	}
+
+	if gid := m.Gid(); gid != "" {
+		if res.active[gid] {
+			return m, nil
+		}
+		res.active[gid] = true
+		defer delete(res.active, gid)
+	}
+	if ret, ok := res.nodes[m]; ok {
+		return ret, nil
+	}
+	ret, err := res.resolveNode(ctx, m)
+	if err == nil {
+		res.nodes[m] = ret
+	}
+	return ret, err
+}
+
+func (res *refResolver) resolveNode(ctx context.Context, m Meta) (Meta, error) {
+	ret := m
+	for _, name := range m.SubNames() {
+		sub, err := res.resolve(ctx, m.Sub(name))
+		if err != nil {
+			return m, err
+		}
+		ret = ret.WithSub(name, sub)
+	}
+	for _, name := range m.RelNames() {
+		rel, err := res.resolve(ctx, m.Rel(name))
+		if err != nil {
+			return m, err
+		}
+		ret = ret.WithRel(name, rel)
+	}
+
+	list := m.List()
+	var newList []Meta
+	for idx, item := range list {
+		n, err := res.resolve(ctx, item)
+		if err != nil {
+			return m, err
+		}
+		if n != item && newList == nil {
+			newList = append(make([]Meta, 0, len(list)), list[:idx]...)
+		}
+		if newList != nil {
+			newList = append(newList, n)
+		}
+	}
+	if newList != nil {
+		ret = ret.WithList(newList, false)
+	}
+	return ret, nil
+}
+
+// Refs returns the refs in m in document order.
+func Refs(m Meta) []Meta {
+	var ret []Meta
+	WalkFunc(m, func(p Path, n Meta) WalkAction {
+		if IsRef(n) {
+			ret = append(ret, n)
+		}
+		return WalkContinue
+	})
+	return ret
+}
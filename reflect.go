@@ -83,3 +83,35 @@ func StructToAttrs(val interface{}, keys ...string) map[string]string {
 	}
 	return ret
 }
+
+// AttrsToStruct is the reverse of StructToAttrs: it sets the fields of basic
+// types of the struct val points to from the attrs with the same names.
+// Missing attrs leave fields untouched; the first parse error, an AttrError,
+// is returned.
+func AttrsToStruct(attrs map[string]string, val interface{}, keys ...string) error {
+	v := reflect.ValueOf(val)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Expected pointer to struct, got %T", val)
+	}
+	v = v.Elem()
+
+	if len(keys) == 0 {
+		for i, n := 0, v.NumField(); i < n; i++ {
+			keys = append(keys, v.Type().Field(i).Name)
+		}
+	}
+	for _, key := range keys {
+		f := v.FieldByName(key)
+		if !f.IsValid() || !f.CanSet() || !IsBasic(f.Interface()) {
+			continue
+		}
+		if s, ok := attrs[key]; ok {
+			fv, err := parseValue(key, s, true, f.Type())
+			if err != nil {
+				return err
+			}
+			f.Set(fv)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,364 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A schema is itself a Meta of kind "Schema". Its tags "kind" and "ns" name
+// the expected kind and ns, and tag "open" set to true allows tags, attrs,
+// subs and rels not declared. The list declares the fields:
+//
+//	Attr / Tag  attrs: name, type, required, values (enum), pattern (regex),
+//	            min, max (int and float)
+//	Sub / Rel   attrs: name, kind, ns, required; optional sub "schema"
+//	List        attrs: kind (comma-separated), min, max; optional sub "schema"
+//
+// Types are string (default), int, bool, float, date (UtcDateFormat), utc
+// (UtcTimeFormat), enum (values comma-separated) and regex (pattern, which
+// must match the whole value).
+//
+//	New("Schema").WithTag("kind", "Customer").WithList([]Meta{
+//		New("Attr").WithAttr("name", "age", "type", "int", "required", "true"),
+//		New("Sub").WithAttr("name", "address", "kind", "Address"),
+//	})
+
+type ValidationError struct {
+	Path    string // e.g. "customer/@account.attr:age"
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+func (e ValidationError) Meta() Meta {
+	return New("ValidationError").WithAttr("path", e.Path, "message", e.Message)
+}
+
+// ValidationErrorMeta returns an Error Meta (code 400) listing errs, or Nil.
+func ValidationErrorMeta(errs []ValidationError) Meta {
+	if len(errs) == 0 {
+		return Nil
+	}
+	items := make([]Meta, len(errs))
+	for i, e := range errs {
+		items[i] = e.Meta()
+	}
+	msg := errs[0].Error()
+	if len(errs) > 1 {
+		msg = fmt.Sprintf("%s (and %d more)", msg, len(errs)-1)
+	}
+	return AjaxError(400, msg).WithList(items)
+}
+
+type Schema struct {
+	kind, ns string
+	open     bool
+	tags     []*fieldSchema
+	attrs    []*fieldSchema
+	subs     []*nodeSchema
+	rels     []*nodeSchema
+	list     *listSchema
+}
+
+type fieldSchema struct {
+	name     string
+	typ      string
+	required bool
+	values   []string
+	pattern  *regexp.Regexp
+	min, max *float64
+}
+
+type nodeSchema struct {
+	name, kind, ns string
+	required       bool
+	schema         *Schema
+}
+
+type listSchema struct {
+	kinds    []string
+	min, max *float64
+	schema   *Schema
+}
+
+var schemaTypes = map[string]bool{
+	"string": true, "int": true, "bool": true, "float": true,
+	"date": true, "utc": true, "enum": true, "regex": true,
+}
+
+func CompileSchema(m Meta) (*Schema, error) {
+	if m.Kind() != "Schema" {
+		return nil, fmt.Errorf("Invalid schema kind %s", m.Kind())
+	}
+
+	s := &Schema{kind: m.Tag("kind"), ns: m.Tag("ns"), open: truth[strings.ToLower(m.Tag("open"))]}
+	for idx, item := range m.List() {
+		name := item.Attr("name")
+		if name == "" && item.Kind() != "List" {
+			return nil, fmt.Errorf("Schema %s field #%d: missing name", s.kind, idx)
+		}
+
+		var err error
+		switch item.Kind() {
+		case "Attr", "Tag":
+			var f *fieldSchema
+			if f, err = compileField(item); err == nil {
+				if item.Kind() == "Tag" {
+					s.tags = append(s.tags, f)
+				} else {
+					s.attrs = append(s.attrs, f)
+				}
+			}
+		case "Sub", "Rel":
+			n := &nodeSchema{name: name, kind: item.Attr("kind"), ns: item.Attr("ns"), required: item.IsTrueAttr("required")}
+			if item.HasSub("schema") {
+				n.schema, err = CompileSchema(item.Sub("schema"))
+			}
+			if item.Kind() == "Sub" {
+				s.subs = append(s.subs, n)
+			} else {
+				s.rels = append(s.rels, n)
+			}
+		case "List":
+			l := &listSchema{}
+			if kinds := item.Attr("kind"); kinds != "" {
+				l.kinds = strings.Split(kinds, ",")
+			}
+			if l.min, err = floatPtrAttr(item, "min"); err == nil {
+				l.max, err = floatPtrAttr(item, "max")
+			}
+			if err == nil && item.HasSub("schema") {
+				l.schema, err = CompileSchema(item.Sub("schema"))
+			}
+			s.list = l
+		default:
+			err = fmt.Errorf("unknown field kind %s", item.Kind())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Schema %s field #%d: %v", s.kind, idx, err)
+		}
+	}
+	return s, nil
+}
+
+func compileField(item Meta) (*fieldSchema, error) {
+	f := &fieldSchema{name: item.Attr("name"), typ: item.Attr("type", "string"), required: item.IsTrueAttr("required")}
+	if !schemaTypes[f.typ] {
+		return nil, fmt.Errorf("unknown type %s", f.typ)
+	}
+
+	var err error
+	switch f.typ {
+	case "enum":
+		f.values = strings.Split(item.Attr("values"), ",")
+	case "regex":
+		if f.pattern, err = regexp.Compile("^(?:" + item.Attr("pattern") + ")$"); err != nil {
+			return nil, err
+		}
+	}
+	if f.min, err = floatPtrAttr(item, "min"); err != nil {
+		return nil, err
+	}
+	if f.max, err = floatPtrAttr(item, "max"); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func floatPtrAttr(m Meta, name string) (*float64, error) {
+	if !m.HasAttr(name) {
+		return nil, nil
+	}
+	v, err := m.FloatAttr(name)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func MustCompileSchema(m Meta) *Schema {
+	s, err := CompileSchema(m)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Validate checks m against the schema Meta; an invalid schema is reported
+// as a single error with an empty path.
+func Validate(schema, m Meta) []ValidationError {
+	s, err := CompileSchema(schema)
+	if err != nil {
+		return []ValidationError{{"", err.Error()}}
+	}
+	return s.Validate(m)
+}
+
+func (s *Schema) Validate(m Meta) []ValidationError {
+	var errs []ValidationError
+	s.validate(Path{}, orNil(m), &errs)
+	return errs
+}
+
+func (s *Schema) validate(p Path, m Meta, errs *[]ValidationError) {
+	report := func(p Path, format string, args ...interface{}) {
+		*errs = append(*errs, ValidationError{p.String(), fmt.Sprintf(format, args...)})
+	}
+
+	if m.IsNil() {
+		report(p, "missing")
+		return
+	}
+	if s.kind != "" && m.Kind() != s.kind {
+		report(p, "expected kind %s, got %s", s.kind, m.Kind())
+		return
+	}
+	if s.ns != "" && m.Ns() != s.ns {
+		report(p, "expected ns %s, got %s", s.ns, m.Ns())
+	}
+
+	validateFields(p, "tag", s.tags, m.TagNames(), m.Tag, s.open, report)
+	validateFields(p, "attr", s.attrs, m.AttrNames(), func(name string) string { return m.Attr(name) }, s.open, report)
+
+	s.validateNodes(p, AxisSub, s.subs, m.SubNames(), m.Sub, errs)
+	s.validateNodes(p, AxisRel, s.rels, m.RelNames(), m.Rel, errs)
+
+	if l := s.list; l != nil {
+		list := m.List()
+		if l.min != nil && float64(len(list)) < *l.min {
+			report(p, "expected at least %v list items, got %d", *l.min, len(list))
+		}
+		if l.max != nil && float64(len(list)) > *l.max {
+			report(p, "expected at most %v list items, got %d", *l.max, len(list))
+		}
+		for idx, item := range list {
+			ip := p.Child(PathStep{Axis: AxisList, Index: idx})
+			if len(l.kinds) > 0 && !contains(l.kinds, item.Kind()) {
+				report(ip, "unexpected kind %s", item.Kind())
+			} else if l.schema != nil {
+				l.schema.validate(ip, item, errs)
+			}
+		}
+	}
+}
+
+func validateFields(p Path, field string, fields []*fieldSchema, names []string, get func(string) string,
+	open bool, report func(Path, string, ...interface{})) {
+	declared := make(map[string]bool, len(fields))
+	present := nameSet(names)
+	for _, f := range fields {
+		declared[f.name] = true
+		fp := Path{Steps: p.Steps, Field: field, Key: f.name}
+		if !present[f.name] {
+			if f.required {
+				report(fp, "required")
+			}
+			continue
+		}
+		if msg := f.check(get(f.name)); msg != "" {
+			report(fp, "%s", msg)
+		}
+	}
+
+	if !open {
+		for _, name := range names {
+			if !declared[name] {
+				report(Path{Steps: p.Steps, Field: field, Key: name}, "not allowed")
+			}
+		}
+	}
+}
+
+func (s *Schema) validateNodes(p Path, axis string, nodes []*nodeSchema, names []string, get func(string) Meta, errs *[]ValidationError) {
+	declared := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		declared[n.name] = true
+		np := p.Child(PathStep{Axis: axis, Name: n.name})
+		sub := get(n.name)
+		if sub.IsNil() {
+			if n.required {
+				*errs = append(*errs, ValidationError{np.String(), "required"})
+			}
+			continue
+		}
+		kind, ref := sub.Kind(), IsRef(sub)
+		if ref { // a Ref stands for its target, whose body is not here
+			kind = sub.Tag("kind")
+		}
+		if n.kind != "" && kind != n.kind || n.ns != "" && sub.Ns() != n.ns {
+			*errs = append(*errs, ValidationError{np.String(), fmt.Sprintf("expected %s, got %s", qualifiedKind(n.ns, n.kind), qualifiedKind(sub.Ns(), kind))})
+			continue
+		}
+		if n.schema != nil && !ref {
+			n.schema.validate(np, sub, errs)
+		}
+	}
+
+	if !s.open {
+		for _, name := range names {
+			if !declared[name] {
+				*errs = append(*errs, ValidationError{p.Child(PathStep{Axis: axis, Name: name}).String(), "not allowed"})
+			}
+		}
+	}
+}
+
+func qualifiedKind(ns, kind string) string {
+	if ns == "" {
+		return kind
+	}
+	return ns + ":" + kind
+}
+
+// check returns the problem with val, or ""
+func (f *fieldSchema) check(val string) string {
+	var num float64
+	var err error
+	switch f.typ {
+	case "int":
+		var i int
+		i, err = strconv.Atoi(val)
+		num = float64(i)
+	case "float":
+		num, err = strconv.ParseFloat(val, 64)
+	case "bool":
+		if _, ok := truth[strings.ToLower(val)]; !ok {
+			return fmt.Sprintf("invalid bool %q", val)
+		}
+	case "date":
+		_, err = time.Parse(UtcDateFormat, val)
+	case "utc":
+		_, err = parseUtc(val)
+	case "enum":
+		if !contains(f.values, val) {
+			return fmt.Sprintf("%q not one of %s", val, strings.Join(f.values, ","))
+		}
+	case "regex":
+		if !f.pattern.MatchString(val) {
+			return fmt.Sprintf("%q does not match %s", val, f.pattern)
+		}
+	}
+	if err != nil {
+		return fmt.Sprintf("invalid %s %q", f.typ, val)
+	}
+
+	if f.typ == "int" || f.typ == "float" {
+		if f.min != nil && num < *f.min {
+			return fmt.Sprintf("%s below min %v", val, *f.min)
+		}
+		if f.max != nil && num > *f.max {
+			return fmt.Sprintf("%s above max %v", val, *f.max)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"testing"
+)
+
+// A rel held as a Ref checks the kind and ns of its target
+func TestValidateRefRel(t *testing.T) {
+	s := MustCompileSchema(New("Schema").WithTag("kind", "Order").WithList([]Meta{
+		New("Rel").WithAttr("name", "account", "kind", "Account", "ns", "bank", "required", "true").
+			WithSub("schema", New("Schema").WithList([]Meta{
+				New("Attr").WithAttr("name", "owner", "required", "true"),
+			})),
+	}))
+
+	acct := New("Account", "", "bank", "acct-1").WithAttr("owner", "Ada")
+	for _, m := range []Meta{
+		New("Order").WithRel("account", acct),
+		New("Order").WithRelRef("account", acct),
+	} {
+		if errs := s.Validate(m); len(errs) != 0 {
+			t.Errorf("%s: %v", CanonicalJson(m), errs)
+		}
+	}
+
+	for _, c := range []struct {
+		m    Meta
+		want string
+	}{
+		{New("Order").WithRelRef("account", New("User", "", "bank", "u-1")), "@account: expected bank:Account, got bank:User"},
+		{New("Order").WithRelRef("account", New("Account", "", "shop", "a-1")), "@account: expected bank:Account, got shop:Account"},
+		{New("Order").WithRelRef("account", New("Account", "", "bank")), "@account: required"},
+	} {
+		errs := s.Validate(c.m)
+		if len(errs) != 1 || errs[0].Error() != c.want {
+			t.Errorf("%s: got %v, want %s", CanonicalJson(c.m), errs, c.want)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Decoder reads a stream of MetaJsons, either one after another as in
+// NDJSON or as a top-level JSON array, holding one Meta in memory at a
+// time.
+type Decoder struct {
+	// StreamList, set before the first Next, reads the input as one Meta
+	// and makes Next return the items of its list one by one; Head gives
+	// the rest of it.
+	StreamList bool
+	// Strict, set before the first Next, parses each Meta as
+	// ParseMetaStrict does, with JSON pointers from the top of the stream.
+	Strict bool
+	// Lenient takes numbers, bools and null for tags and attrs as
+	// ParseMetaLenient does, also in Strict mode.
+	Lenient bool
+
+	r       *bufio.Reader
+	d       *json.Decoder
+	skipped int64 // whitespace read by peek, not by d
+	state   int
+	n       int    // items read from the array or list
+	head    []byte // the fields but the list as a JSON object
+	headAt  []headOffset
+	keys    map[string]bool
+}
+
+// headOffset maps an offset in head to one in the input, for the bytes up
+// to the next headOffset
+type headOffset struct {
+	head, input int64
+}
+
+const (
+	decStart = iota
+	decValues
+	decArray
+	decListFields
+	decListItems
+	decDone
+)
+
+func NewDecoder(r io.Reader) *Decoder {
+	br := bufio.NewReader(r)
+	return &Decoder{r: br, d: json.NewDecoder(br)}
+}
+
+// Next returns the next Meta, or io.EOF at the end of the stream.
+func (d *Decoder) Next() (Meta, error) {
+	if d.state == decStart {
+		if err := d.start(); err != nil {
+			return Nil, err
+		}
+	}
+
+	switch d.state {
+	case decValues:
+		if !d.d.More() {
+			d.state = decDone
+			return Nil, io.EOF
+		}
+		return d.decode()
+	case decArray:
+		if !d.d.More() {
+			if _, err := d.d.Token(); err != nil { // the ]
+				return Nil, d.errorf(err)
+			}
+			d.state = decDone
+			if d.d.More() {
+				return Nil, d.errorf(errors.New("more after the array"))
+			}
+			return Nil, io.EOF
+		}
+		return d.decode()
+	case decListFields, decListItems:
+		return d.nextItem()
+	}
+	return Nil, io.EOF
+}
+
+// start looks at the first token to tell an array from a sequence
+func (d *Decoder) start() error {
+	d.state = decValues
+	c, err := d.peek()
+	if err == io.EOF {
+		return nil // empty, Next returns io.EOF
+	} else if err != nil {
+		return err
+	}
+
+	if d.StreamList {
+		if c != '{' {
+			return d.errorf(errors.New("expected an object to stream its list"))
+		}
+		d.d.Token()
+		d.state = decListFields
+		d.head = append(d.head[:0], '{')
+		d.headAt = append(d.headAt[:0], headOffset{0, d.offset() - 1})
+	} else if c == '[' {
+		d.d.Token()
+		d.state = decArray
+	}
+	return nil
+}
+
+// peek returns the first byte after whitespace without consuming it
+func (d *Decoder) peek() (byte, error) {
+	for {
+		c, err := d.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			return c, d.r.UnreadByte()
+		}
+		d.skipped++
+	}
+}
+
+func (d *Decoder) decode() (Meta, error) {
+	defer func() { d.n++ }()
+	if d.Strict {
+		var raw json.RawMessage
+		if err := d.d.Decode(&raw); err != nil {
+			return Nil, d.errorf(err)
+		}
+		ptr := ""
+		switch d.state {
+		case decArray:
+			ptr = "/" + strconv.Itoa(d.n)
+		case decListItems:
+			ptr = "/list/" + strconv.Itoa(d.n)
+		}
+		return newStrictParser(raw, d.offset()-int64(len(raw)), ptr, d.Lenient).parse(d.state != decListItems)
+	}
+
+	if d.Lenient {
+		var lj lenientJson
+		if err := d.d.Decode(&lj); err != nil {
+			return Nil, d.errorf(err)
+		}
+		mj := lj.metaJson()
+		if err := mj.checkPayloads(); err != nil {
+			return Nil, d.errorf(err)
+		}
+		return JsonToMeta(mj), nil
+	}
+	var mj MetaJson
+	if err := d.d.Decode(&mj); err != nil {
+		return Nil, d.errorf(err)
+	}
+	if err := mj.checkPayloads(); err != nil {
+		return Nil, d.errorf(err)
+	}
+	return JsonToMeta(mj), nil
+}
+
+// nextItem reads the fields of the Meta up to the list, or the next item
+// of the list
+func (d *Decoder) nextItem() (Meta, error) {
+	for {
+		if d.state == decListItems {
+			if d.d.More() {
+				return d.decode()
+			}
+			if _, err := d.d.Token(); err != nil { // the ]
+				return Nil, d.errorf(err)
+			}
+			d.state = decListFields
+		}
+
+		tok, err := d.d.Token()
+		if err != nil {
+			return Nil, d.errorf(err)
+		}
+		if tok == json.Delim('}') {
+			d.state = decDone
+			d.headAt = append(d.headAt, headOffset{int64(len(d.head)), d.offset() - 1})
+			d.head = append(d.head, '}')
+			if d.d.More() {
+				return Nil, d.errorf(errors.New("more after the object"))
+			}
+			return Nil, io.EOF
+		}
+		key, _ := tok.(string)
+		if d.Strict {
+			if err := d.checkKey(key); err != nil {
+				return Nil, err
+			}
+		}
+		if strings.EqualFold(key, "list") { // matched as by encoding/json
+			if tok, err = d.d.Token(); err != nil {
+				return Nil, d.errorf(err)
+			}
+			if tok == nil {
+				continue
+			}
+			if tok != json.Delim('[') {
+				return Nil, d.errorf(errors.New("list is not an array"))
+			}
+			d.state = decListItems
+			continue
+		}
+
+		var val json.RawMessage
+		if err := d.d.Decode(&val); err != nil {
+			return Nil, d.errorf(err)
+		}
+		if len(d.head) > 1 {
+			d.head = append(d.head, ',')
+		}
+		name, _ := json.Marshal(key)
+		d.head = append(append(d.head, name...), ':')
+		d.headAt = append(d.headAt, headOffset{int64(len(d.head)), d.offset() - int64(len(val))})
+		d.head = append(d.head, val...)
+	}
+}
+
+// checkKey rejects unknown and duplicate fields in Strict mode, at the
+// offsets ParseMetaStrict gives: of the value, and of the key as written
+// without escapes
+func (d *Decoder) checkKey(key string) error {
+	ptr := "/" + jsonPointerEscape(key)
+	switch key {
+	case "kind", "method", "ns", "gid", "tags", "attrs", "payload", "payloadType", "payloadEncoding", "subs", "rels", "list":
+	default:
+		var val json.RawMessage
+		if err := d.d.Decode(&val); err != nil {
+			return d.errorf(err)
+		}
+		return &JsonError{ptr, d.offset() - int64(len(val)), "unknown field " + strconv.Quote(key)}
+	}
+	if d.keys == nil {
+		d.keys = map[string]bool{}
+	}
+	if d.keys[key] {
+		name, _ := json.Marshal(key)
+		return &JsonError{ptr, d.offset() - int64(len(name)), "duplicate key " + strconv.Quote(key)}
+	}
+	d.keys[key] = true
+	return nil
+}
+
+// Head returns the Meta being streamed with StreamList, without its list;
+// fields after the list are there only after Next returns io.EOF. In Strict
+// mode the types of the fields are checked here, with JsonError offsets in
+// the input.
+func (d *Decoder) Head() (Meta, error) {
+	if len(d.head) == 0 {
+		return Nil, nil
+	}
+	head := d.head
+	if d.state != decDone {
+		head = append(head[:len(head):len(head)], '}')
+	}
+	if d.Strict {
+		m, err := newStrictParser(head, 0, "", d.Lenient).parse(true)
+		if je, ok := err.(*JsonError); ok {
+			je.Offset = d.inputOffset(je.Offset)
+		}
+		return m, err
+	}
+	if d.Lenient {
+		return ParseMetaLenient(head)
+	}
+	return ParseMeta(head)
+}
+
+// inputOffset maps an offset in head to the input
+func (d *Decoder) inputOffset(off int64) int64 {
+	at := d.headAt[0]
+	for _, ho := range d.headAt[1:] {
+		if ho.head > off {
+			break
+		}
+		at = ho
+	}
+	return at.input + off - at.head
+}
+
+// offset is the input offset of the end of the last token
+func (d *Decoder) offset() int64 {
+	return d.skipped + d.d.InputOffset()
+}
+
+func (d *Decoder) errorf(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("Invalid json meta at %d: %w", d.offset(), err)
+}
+
+// Encoder writes Metas as NDJSON, one per line, or as a JSON array; with
+// BeginList, the Metas are the items of the list of one Meta instead.
+type Encoder struct {
+	Array bool // write a JSON array, closed by Close
+
+	w       io.Writer
+	n       int
+	inList  bool
+	started bool
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// BeginList writes head, but its list, and starts its list for the Metas
+// of the following Encode calls, closed by Close.
+func (e *Encoder) BeginList(head Meta) error {
+	if e.started {
+		return errors.New("BeginList after Encode")
+	}
+	mj := MetaToJson(head)
+	mj.List = nil
+	buf, err := json.Marshal(mj)
+	if err != nil {
+		return err
+	}
+	buf = buf[:len(buf)-1] // the }
+	if len(buf) > 1 {
+		buf = append(buf, ',')
+	}
+	buf = append(buf, `"list":[`...)
+	e.started, e.inList = true, true
+	_, err = e.w.Write(buf)
+	return err
+}
+
+func (e *Encoder) Encode(m Meta) error {
+	buf, err := json.Marshal(MetaToJson(m))
+	if err != nil {
+		return err
+	}
+
+	var pre []byte
+	switch {
+	case e.inList && e.n > 0:
+		pre = []byte{','}
+	case e.inList:
+	case e.Array && e.n == 0:
+		pre = []byte{'['}
+	case e.Array:
+		pre = []byte{',', '\n'}
+	}
+	if !e.inList && !e.Array {
+		buf = append(buf, '\n')
+	}
+	e.started = true
+	e.n++
+	if _, err := e.w.Write(append(pre, buf...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Close ends the array or the list; it does not close the writer.
+func (e *Encoder) Close() error {
+	var end string
+	switch {
+	case e.inList:
+		end = "]}\n"
+	case e.Array && e.n == 0:
+		end = "[]\n"
+	case e.Array:
+		end = "]\n"
+	}
+	e.inList, e.n = false, 0
+	if end == "" {
+		return nil
+	}
+	_, err := io.WriteString(e.w, end)
+	return err
+}
+
+// ParseMetas parses a JSON array of MetaJsons or NDJSON.
+func ParseMetas(buf []byte) ([]Meta, error) {
+	var ret []Meta
+	d := NewDecoder(bytes.NewReader(buf))
+	for {
+		m, err := d.Next()
+		if err == io.EOF {
+			return ret, nil
+		} else if err != nil {
+			return nil, err
+		}
+		ret = append(ret, m)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// streamAll reads all the Metas of in, and the head with StreamList
+func streamAll(d *Decoder) ([]Meta, Meta, error) {
+	var ms []Meta
+	for {
+		m, err := d.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return ms, Nil, err
+		}
+		ms = append(ms, m)
+	}
+	head, err := d.Head()
+	return ms, head, err
+}
+
+func sameMetas(a, b []Meta) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDecoder(t *testing.T) {
+	a, b := New("A").WithAttr("x", "1"), New("B", "", "ns")
+	for _, c := range []struct {
+		in   string
+		want []Meta
+	}{
+		{"", nil},
+		{" \n", nil},
+		{`{"kind":"A","attrs":{"x":"1"}}` + "\n" + `{"kind":"B","ns":"ns"}` + "\n", []Meta{a, b}},
+		{`{"kind":"A","attrs":{"x":"1"}} {"kind":"B","ns":"ns"}`, []Meta{a, b}},
+		{"  [\n" + `{"kind":"A","attrs":{"x":"1"}},` + "\n" + `{"kind":"B","ns":"ns"}]` + "\n", []Meta{a, b}},
+		{"[]", nil},
+		{`[{}, {"kind":"A","attrs":{"x":"1"}}]`, []Meta{Nil, a}},
+	} {
+		for _, strict := range []bool{false, true} {
+			d := NewDecoder(strings.NewReader(c.in))
+			d.Strict = strict
+			ms, _, err := streamAll(d)
+			if err != nil || !sameMetas(ms, c.want) {
+				t.Errorf("%q strict %v: got %v, %v", c.in, strict, ms, err)
+			}
+		}
+	}
+}
+
+func TestDecoderStreamList(t *testing.T) {
+	items := []Meta{New("Item").WithAttr("n", "1"), New("Item").WithAttr("n", "2")}
+	head := New("Order").WithAttr("id", "o-1").WithTag("t", "v")
+	for _, in := range []string{
+		`{"kind":"Order","attrs":{"id":"o-1"},"list":[{"kind":"Item","attrs":{"n":"1"}},{"kind":"Item","attrs":{"n":"2"}}],"tags":{"t":"v"}}`,
+		` {"list":[{"kind":"Item","attrs":{"n":"1"}}, {"kind":"Item","attrs":{"n":"2"}}], "kind":"Order", "tags":{"t":"v"}, "attrs":{"id":"o-1"}}` + "\n",
+		`{"kind":"Order","attrs":{"id":"o-1"},"List":[{"kind":"Item","attrs":{"n":"1"}},{"kind":"Item","attrs":{"n":"2"}}],"tags":{"t":"v"}}`,
+		`{"kind":"Order","attrs":{"id":"o-1"},"LIST":null,"list":[{"kind":"Item","attrs":{"n":"1"}},{"kind":"Item","attrs":{"n":"2"}}],"tags":{"t":"v"}}`,
+	} {
+		d := NewDecoder(strings.NewReader(in))
+		d.StreamList = true
+		ms, got, err := streamAll(d)
+		if err != nil || !sameMetas(ms, items) || !Equal(got, head) {
+			t.Errorf("%s: got %v, %v, %v", in, ms, got, err)
+		}
+	}
+
+	// the head before the list is there from the first item on
+	d := NewDecoder(strings.NewReader(`{"kind":"Order","list":[{"kind":"Item"}],"attrs":{"id":"o-1"}}`))
+	d.StreamList = true
+	if _, err := d.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := d.Head(); err != nil || !Equal(got, New("Order")) {
+		t.Errorf("got %v, %v", got, err)
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	for _, c := range []struct {
+		in         string
+		streamList bool
+		want       string
+	}{
+		{`[{"kind":"A"}] {"kind":"B"}`, false, "more after the array"},
+		{`[{"kind":"A"}`, false, "unexpected end"},
+		{`{"kind":"A"} [`, false, "Invalid json meta"},
+		{`[{"kind":"A"}]`, true, "expected an object to stream its list"},
+		{`{"kind":"A","list":{}}`, true, "list is not an array"},
+		{`{"kind":"A","list":[]} {}`, true, "more after the object"},
+	} {
+		d := NewDecoder(strings.NewReader(c.in))
+		d.StreamList = c.streamList
+		if _, _, err := streamAll(d); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got %v, want %s", c.in, err, c.want)
+		}
+	}
+}
+
+// Strict errors give offsets in the input, also from Head
+func TestDecoderStrictOffsets(t *testing.T) {
+	for _, c := range []struct {
+		in         string
+		streamList bool
+		ptr        string
+		off        int64
+	}{
+		{"\n\n  " + `{"kind":"A","bogus":1}`, false, "/bogus", 24},
+		{"\n\n  " + `{"kind":"A","bogus":1,"list":[]}`, true, "/bogus", 24},
+		{`{"kind":"A", "kind":"B","list":[]}`, true, "/kind", 13},
+		{` [{"kind":"A"}, {"kind":"B","attrs":[]}]`, false, "/1/attrs", 36},
+		{"  " + `{"kind":"A","attrs":{"x":[]},"list":[]}`, true, "/attrs/x", 27},
+		{`{"list":[], "kind" : "A",  "tags" :  3}`, true, "/tags", 37},
+		{"\n" + `{"attrs":{},"list":[{"kind":"B"}]}`, true, "", 1},
+		{`{"kind":"A","list":[{"kind":"B","gid":1}]}`, true, "/list/0/gid", 38},
+	} {
+		d := NewDecoder(strings.NewReader(c.in))
+		d.StreamList, d.Strict = c.streamList, true
+		_, _, err := streamAll(d)
+		var je *JsonError
+		if !errors.As(err, &je) || je.Pointer != c.ptr || je.Offset != c.off {
+			t.Errorf("%q: got %v, want %s at %d", c.in, err, c.ptr, c.off)
+		}
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	ms := []Meta{New("A").WithAttr("x", "1"), New("B", "", "ns")}
+	head := New("Order").WithAttr("id", "o-1")
+	for _, mode := range []string{"ndjson", "array", "list"} {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		e.Array = mode == "array"
+		if mode == "list" {
+			if err := e.BeginList(head); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, m := range ms {
+			if err := e.Encode(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := e.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		d := NewDecoder(&buf)
+		d.StreamList = mode == "list"
+		got, gotHead, err := streamAll(d)
+		if err != nil || !sameMetas(got, ms) {
+			t.Errorf("%s: got %v, %v", mode, got, err)
+		}
+		if mode == "list" && !Equal(gotHead, head) {
+			t.Errorf("head %v", gotHead)
+		}
+	}
+}
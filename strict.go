@@ -0,0 +1,237 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// JsonError reports where strict parsing failed, by a JSON pointer to the
+// value, like "/subs/customer/attrs/age", and its byte offset.
+type JsonError struct {
+	Pointer string
+	Offset  int64
+	Msg     string
+}
+
+func (e *JsonError) Error() string {
+	if e.Pointer == "" {
+		return fmt.Sprintf("Invalid json meta at offset %d: %s", e.Offset, e.Msg)
+	}
+	return fmt.Sprintf("Invalid json meta at %s (offset %d): %s", e.Pointer, e.Offset, e.Msg)
+}
+
+// ParseMetaStrict is ParseMeta but rejects what ParseMeta lets pass or
+// drops: unknown fields (with field names matched exactly), duplicate keys,
+// values of other types than MetaJson's including null, nested nodes with
+// no kind, and anything after the Meta. Errors are JsonErrors.
+func ParseMetaStrict(buf []byte) (Meta, error) {
+	return newStrictParser(buf, 0, "", false).parse(true)
+}
+
+type strictParser struct {
+	buf     []byte
+	base    int64  // offset of buf in the input
+	prefix  string // pointer of buf in the input
+	lenient bool   // numbers, bools and null for tags and attrs
+	d       *json.Decoder
+}
+
+func newStrictParser(buf []byte, base int64, prefix string, lenient bool) *strictParser {
+	d := json.NewDecoder(bytes.NewReader(buf))
+	d.UseNumber()
+	return &strictParser{buf, base, prefix, lenient, d}
+}
+
+// parse reads the only node in buf, which may be Nil if top
+func (p *strictParser) parse(top bool) (Meta, error) {
+	m, err := p.node("", top)
+	if err != nil {
+		return Nil, err
+	}
+	off := p.next()
+	if _, err := p.d.Token(); err != io.EOF {
+		return Nil, p.errorAt("", off, "data after the meta")
+	}
+	return m, nil
+}
+
+func (p *strictParser) errorAt(ptr string, off int64, msg string) error {
+	return &JsonError{p.prefix + ptr, p.base + off, msg}
+}
+
+// next returns the offset of the next token, past separators the decoder
+// has not consumed
+func (p *strictParser) next() int64 {
+	off := p.d.InputOffset()
+	for off < int64(len(p.buf)) && strings.IndexByte(" \t\r\n:,", p.buf[off]) >= 0 {
+		off++
+	}
+	return off
+}
+
+func (p *strictParser) token(ptr string) (json.Token, int64, error) {
+	off := p.next()
+	tok, err := p.d.Token()
+	if err != nil {
+		var se *json.SyntaxError
+		if errors.As(err, &se) {
+			return nil, off, p.errorAt(ptr, se.Offset, se.Error())
+		}
+		if err == io.EOF {
+			return nil, off, p.errorAt(ptr, off, "unexpected end")
+		}
+		return nil, off, err
+	}
+	return tok, off, nil
+}
+
+func (p *strictParser) delim(ptr string, delim json.Delim, what string) error {
+	tok, off, err := p.token(ptr)
+	if err == nil && tok != delim {
+		err = p.errorAt(ptr, off, "expected "+what)
+	}
+	return err
+}
+
+func (p *strictParser) str(ptr string) (string, error) {
+	tok, off, err := p.token(ptr)
+	if err != nil {
+		return "", err
+	}
+	s, ok := tok.(string)
+	if !ok {
+		return "", p.errorAt(ptr, off, "expected a string")
+	}
+	return s, nil
+}
+
+// scalar reads a tag or attr value, as ParseMetaLenient if lenient
+func (p *strictParser) scalar(ptr string) (string, error) {
+	if !p.lenient {
+		return p.str(ptr)
+	}
+	tok, off, err := p.token(ptr)
+	if err != nil {
+		return "", err
+	}
+	switch v := tok.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return string(v), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case nil:
+		return "", nil
+	}
+	return "", p.errorAt(ptr, off, "expected a string, number, bool or null")
+}
+
+// entries reads an object, calling fn with each key and its pointer
+func (p *strictParser) entries(ptr string, fn func(key, ptr string) error) error {
+	if err := p.delim(ptr, '{', "an object"); err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for p.d.More() {
+		tok, off, err := p.token(ptr)
+		if err != nil {
+			return err
+		}
+		key := tok.(string)
+		kptr := ptr + "/" + jsonPointerEscape(key)
+		if seen[key] {
+			return p.errorAt(kptr, off, "duplicate key "+strconv.Quote(key))
+		}
+		seen[key] = true
+		if err := fn(key, kptr); err != nil {
+			return err
+		}
+	}
+	_, _, err := p.token(ptr) // the }
+	return err
+}
+
+func (p *strictParser) node(ptr string, top bool) (Meta, error) {
+	start := p.next()
+	b := &Builder{}
+	var payload, ctype, enc string
+	fields := 0
+	err := p.entries(ptr, func(key, kptr string) error {
+		fields++
+		var err error
+		switch key {
+		case "kind":
+			b.kind, err = p.str(kptr)
+		case "method":
+			b.mthd, err = p.str(kptr)
+		case "ns":
+			b.ns, err = p.str(kptr)
+		case "gid":
+			b.gid, err = p.str(kptr)
+		case "payload":
+			payload, err = p.str(kptr)
+		case "payloadType":
+			ctype, err = p.str(kptr)
+		case "payloadEncoding":
+			enc, err = p.str(kptr)
+		case "tags", "attrs":
+			set := b.SetTag
+			if key == "attrs" {
+				set = b.SetAttr
+			}
+			err = p.entries(kptr, func(name, nptr string) error {
+				val, err := p.scalar(nptr)
+				set(name, val)
+				return err
+			})
+		case "subs", "rels":
+			set := b.SetSub
+			if key == "rels" {
+				set = b.SetRel
+			}
+			err = p.entries(kptr, func(name, nptr string) error {
+				m, err := p.node(nptr, false)
+				set(name, m)
+				return err
+			})
+		case "list":
+			if err = p.delim(kptr, '[', "an array"); err != nil {
+				return err
+			}
+			for i := 0; p.d.More(); i++ {
+				m, err := p.node(kptr+"/"+strconv.Itoa(i), false)
+				if err != nil {
+					return err
+				}
+				b.AppendList(m)
+			}
+			_, _, err = p.token(kptr) // the ]
+		default:
+			_, off, _ := p.token(kptr) // to report the value
+			err = p.errorAt(kptr, off, "unknown field "+strconv.Quote(key))
+		}
+		return err
+	})
+	if err != nil {
+		return Nil, err
+	}
+	if b.kind == "" && (!top || fields > 0) {
+		return Nil, p.errorAt(ptr, start, "missing kind")
+	}
+	if b.payload, err = decodePayload(payload, ctype, enc); err != nil {
+		return Nil, p.errorAt(ptr+"/payload", start, err.Error())
+	}
+	return b.Build(), nil
+}
+
+func jsonPointerEscape(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
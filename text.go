@@ -0,0 +1,514 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The text notation writes a Meta as
+//
+//	ns:Kind.method#gid [tag=v, flag] {
+//		attr: "some value"
+//		count: 42
+//		payload "..."
+//		sub address: Address { zip: "10001" }
+//		rel owner: User#u1
+//		list: [Item, Item { qty: 2 }]
+//	}
+//
+// where everything but the kind is optional and Nil is nil. Names and values
+// are bare words (letters, digits and _-+$, values also ./@) or quoted Go
+// strings, "..." or `...`. Entries and items may be separated by ";" and
+// "," or just whitespace, and // starts a comment. A tag without a value has
+// value "". Quoting a name, as in "sub": x, makes it an attr even if it
+// looks like a keyword. A bytes payload has its type in parentheses, as in
+// payload(image/png) "\x89PNG...".
+
+// TextError reports the line and column, both from 1, of a syntax error.
+type TextError struct {
+	Line, Col int
+	Msg       string
+}
+
+func (e *TextError) Error() string {
+	return fmt.Sprintf("Invalid text at %d:%d: %s", e.Line, e.Col, e.Msg)
+}
+
+const maxTextDepth = 10000
+
+func ParseText(s string) (Meta, error) {
+	p := &textParser{src: s, line: 1, col: 1}
+	m, err := p.meta(0)
+	if err != nil {
+		return Nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.src) {
+		return Nil, p.errorf("unexpected %q", p.peek())
+	}
+	return m, nil
+}
+
+func MustParseText(s string) Meta {
+	m, err := ParseText(s)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+type textParser struct {
+	src       string
+	pos       int
+	line, col int
+}
+
+func (p *textParser) errorf(format string, args ...interface{}) error {
+	return &TextError{p.line, p.col, fmt.Sprintf(format, args...)}
+}
+
+// peek returns the next rune, or -1 at the end
+func (p *textParser) peek() rune {
+	if p.pos >= len(p.src) {
+		return -1
+	}
+	r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+	return r
+}
+
+func (p *textParser) next() rune {
+	r, n := utf8.DecodeRuneInString(p.src[p.pos:])
+	p.pos += n
+	if r == '\n' {
+		p.line, p.col = p.line+1, 1
+	} else {
+		p.col++
+	}
+	return r
+}
+
+func (p *textParser) skipSpace() {
+	for p.pos < len(p.src) {
+		if r := p.peek(); unicode.IsSpace(r) {
+			p.next()
+		} else if strings.HasPrefix(p.src[p.pos:], "//") {
+			for p.pos < len(p.src) && p.peek() != '\n' {
+				p.next()
+			}
+		} else {
+			return
+		}
+	}
+}
+
+// skip consumes r, after spaces, if it is next
+func (p *textParser) skip(r rune) bool {
+	p.skipSpace()
+	if p.peek() == r {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *textParser) expect(r rune) error {
+	if !p.skip(r) {
+		return p.unexpected(fmt.Sprintf("%q", r))
+	}
+	return nil
+}
+
+func (p *textParser) unexpected(expected string) error {
+	if p.pos >= len(p.src) {
+		return p.errorf("unexpected end, expected %s", expected)
+	}
+	return p.errorf("unexpected %q, expected %s", p.peek(), expected)
+}
+
+func isWordRune(r rune, value bool) bool {
+	switch {
+	case unicode.IsLetter(r), unicode.IsDigit(r), r == '_', r == '-', r == '+', r == '$':
+		return true
+	case value:
+		return r == '.' || r == '/' || r == '@'
+	}
+	return false
+}
+
+// word reads a quoted string or a bare word; quoted tells which
+func (p *textParser) word(value bool, what string) (s string, quoted bool, err error) {
+	p.skipSpace()
+	switch r := p.peek(); {
+	case r == '"' || r == '`':
+		s, err = p.quoted()
+		return s, true, err
+	case r >= 0 && isWordRune(r, value):
+		start := p.pos
+		for p.pos < len(p.src) && isWordRune(p.peek(), value) {
+			p.next()
+		}
+		return p.src[start:p.pos], false, nil
+	}
+	return "", false, p.unexpected(what)
+}
+
+func (p *textParser) quoted() (string, error) {
+	line, col, start := p.line, p.col, p.pos
+	quote := p.next()
+	for {
+		switch r := p.peek(); {
+		case r < 0 || r == '\n' && quote == '"':
+			return "", &TextError{line, col, "unterminated string"}
+		case r == '\\' && quote == '"':
+			p.next()
+			if p.pos < len(p.src) {
+				p.next()
+			}
+		case r == quote:
+			p.next()
+			s, err := strconv.Unquote(p.src[start:p.pos])
+			if err != nil {
+				return "", &TextError{line, col, "invalid string " + p.src[start:p.pos]}
+			}
+			return s, nil
+		default:
+			p.next()
+		}
+	}
+}
+
+func (p *textParser) meta(depth int) (Meta, error) {
+	if depth > maxTextDepth {
+		return Nil, p.errorf("nested too deep")
+	}
+	first, quoted, err := p.word(false, "kind")
+	if err != nil {
+		return Nil, err
+	}
+	if first == "nil" && !quoted {
+		return Nil, nil
+	}
+
+	b := &Builder{kind: first}
+	if p.skip(':') {
+		b.ns = first
+		if b.kind, _, err = p.word(false, "kind"); err != nil {
+			return Nil, err
+		}
+	}
+	if b.kind == "" {
+		return Nil, p.errorf("empty kind")
+	}
+	if p.skip('.') {
+		if b.mthd, _, err = p.word(false, "method"); err != nil {
+			return Nil, err
+		}
+	}
+	if p.skip('#') {
+		if b.gid, _, err = p.word(true, "gid"); err != nil {
+			return Nil, err
+		}
+	}
+
+	if p.skip('[') {
+		if err := p.tags(b); err != nil {
+			return Nil, err
+		}
+	}
+	if p.skip('{') {
+		if err := p.body(b, depth); err != nil {
+			return Nil, err
+		}
+	}
+	return b.Build(), nil
+}
+
+func (p *textParser) tags(b *Builder) error {
+	for !p.skip(']') {
+		line, col := p.line, p.col
+		name, _, err := p.word(false, "tag name or ']'")
+		if err != nil {
+			return err
+		}
+		if _, ok := b.tags[name]; ok {
+			return &TextError{line, col, "duplicate tag " + name}
+		}
+		val := ""
+		if p.skip('=') {
+			if val, _, err = p.word(true, "tag value"); err != nil {
+				return err
+			}
+		}
+		b.SetTag(name, val)
+		p.skip(',')
+	}
+	return nil
+}
+
+func (p *textParser) body(b *Builder, depth int) error {
+	for !p.skip('}') {
+		if p.skip(';') {
+			continue
+		}
+		line, col := p.line, p.col
+		dup := func(what, name string) error {
+			return &TextError{line, col, fmt.Sprintf("duplicate %s %s", what, name)}
+		}
+
+		name, quoted, err := p.word(false, "name or '}'")
+		if err != nil {
+			return err
+		}
+		p.skipSpace()
+		keyword := !quoted && p.peek() != ':'
+
+		switch {
+		case keyword && (name == "sub" || name == "rel"):
+			child, _, err := p.word(false, name+" name")
+			if err != nil {
+				return err
+			}
+			if err := p.expect(':'); err != nil {
+				return err
+			}
+			m, err := p.meta(depth + 1)
+			if err != nil {
+				return err
+			}
+			if name == "sub" {
+				if _, ok := b.subs[child]; ok {
+					return dup("sub", child)
+				}
+				b.SetSub(child, m)
+			} else {
+				if _, ok := b.rels[child]; ok {
+					return dup("rel", child)
+				}
+				b.SetRel(child, m)
+			}
+
+		case keyword && name == "payload":
+			var ctype string
+			if p.skip('(') {
+				if ctype, _, err = p.word(true, "payload type"); err != nil {
+					return err
+				}
+				if err := p.expect(')'); err != nil {
+					return err
+				}
+			}
+			data, _, err := p.word(false, "payload string")
+			if err != nil {
+				return err
+			}
+			if b.payload = (payloadData{data, ctype}); data == "" {
+				b.payload = payloadData{}
+			}
+
+		case keyword:
+			return p.unexpected("':'")
+
+		default:
+			p.next() // ':'
+			if p.skipSpace(); !quoted && name == "list" && p.peek() == '[' {
+				p.next()
+				if len(b.list) > 0 {
+					return dup("list", "")
+				}
+				if err := p.list(b, depth); err != nil {
+					return err
+				}
+				break
+			}
+			val, _, err := p.word(true, "value")
+			if err != nil {
+				return err
+			}
+			if _, ok := b.attrs[name]; ok {
+				return dup("attr", name)
+			}
+			b.SetAttr(name, val)
+		}
+	}
+	return nil
+}
+
+func (p *textParser) list(b *Builder, depth int) error {
+	for !p.skip(']') {
+		m, err := p.meta(depth + 1)
+		if err != nil {
+			return err
+		}
+		b.AppendList(m)
+		p.skip(',')
+	}
+	return nil
+}
+
+// FormatText writes m in the text notation, one entry per line.
+func FormatText(m Meta) string {
+	w := &textWriter{indent: "  ", stack: map[Meta]bool{}}
+	w.meta(orNil(m), 0)
+	return w.sb.String()
+}
+
+// CompactText writes m in the text notation on one line, e.g. for logs.
+func CompactText(m Meta) string {
+	w := &textWriter{stack: map[Meta]bool{}}
+	w.meta(orNil(m), 0)
+	return w.sb.String()
+}
+
+type textWriter struct {
+	sb     strings.Builder
+	indent string
+	stack  map[Meta]bool
+}
+
+func (w *textWriter) word(s string, value bool) {
+	bare := s != "" && s != "nil" && !strings.HasPrefix(s, "//")
+	for _, r := range s {
+		if !isWordRune(r, value) {
+			bare = false
+			break
+		}
+	}
+	if bare {
+		w.sb.WriteString(s)
+	} else {
+		w.sb.WriteString(strconv.Quote(s))
+	}
+}
+
+// name writes an attr name, quoted if it looks like a keyword
+func (w *textWriter) name(s string) {
+	if s == "sub" || s == "rel" || s == "payload" || s == "list" {
+		w.sb.WriteString(strconv.Quote(s))
+	} else {
+		w.word(s, false)
+	}
+}
+
+// newline starts an entry at depth, or separates it in compact mode
+func (w *textWriter) newline(depth int, first bool) {
+	if w.indent == "" {
+		if first {
+			w.sb.WriteByte(' ')
+		} else {
+			w.sb.WriteString("; ")
+		}
+		return
+	}
+	w.sb.WriteByte('\n')
+	w.sb.WriteString(strings.Repeat(w.indent, depth))
+}
+
+func (w *textWriter) meta(m Meta, depth int) {
+	if m.IsNil() {
+		w.sb.WriteString("nil")
+		return
+	}
+	if w.stack[m] {
+		m = Ref(m)
+	}
+	w.stack[m] = true
+	defer delete(w.stack, m)
+
+	if ns := m.Ns(); ns != "" {
+		w.word(ns, false)
+		w.sb.WriteByte(':')
+	}
+	w.word(m.Kind(), false)
+	if mthd := m.Method(); mthd != "" {
+		w.sb.WriteByte('.')
+		w.word(mthd, false)
+	}
+	if gid := m.Gid(); gid != "" {
+		w.sb.WriteByte('#')
+		w.word(gid, true)
+	}
+
+	if names := m.TagNames(); len(names) > 0 {
+		w.sb.WriteString(" [")
+		for i, name := range names {
+			if i > 0 {
+				w.sb.WriteString(", ")
+			}
+			w.word(name, false)
+			if val := m.Tag(name); val != "" {
+				w.sb.WriteByte('=')
+				w.word(val, true)
+			}
+		}
+		w.sb.WriteByte(']')
+	}
+
+	if m.AttrCount() == 0 && m.Payload() == "" && m.SubCount() == 0 && m.RelCount() == 0 && len(m.List()) == 0 {
+		return
+	}
+	w.sb.WriteString(" {")
+	first := true
+	entry := func() {
+		w.newline(depth+1, first)
+		first = false
+	}
+	for _, name := range m.AttrNames() {
+		entry()
+		w.name(name)
+		w.sb.WriteString(": ")
+		w.word(m.Attr(name), true)
+	}
+	if payload := m.Payload(); payload != "" {
+		entry()
+		w.sb.WriteString("payload")
+		if ctype := m.PayloadType(); ctype != "" {
+			w.sb.WriteString("(")
+			w.word(ctype, true)
+			w.sb.WriteString(")")
+		}
+		w.sb.WriteString(" ")
+		w.sb.WriteString(strconv.Quote(payload))
+	}
+	for _, name := range m.SubNames() {
+		entry()
+		w.sb.WriteString("sub ")
+		w.word(name, false)
+		w.sb.WriteString(": ")
+		w.meta(m.Sub(name), depth+1)
+	}
+	for _, name := range m.RelNames() {
+		entry()
+		w.sb.WriteString("rel ")
+		w.word(name, false)
+		w.sb.WriteString(": ")
+		w.meta(m.Rel(name), depth+1)
+	}
+	if list := m.List(); len(list) > 0 {
+		entry()
+		w.sb.WriteString("list: [")
+		for i, item := range list {
+			if w.indent == "" {
+				if i > 0 {
+					w.sb.WriteString(", ")
+				}
+			} else {
+				w.newline(depth+2, false)
+			}
+			w.meta(item, depth+2)
+		}
+		if w.indent != "" {
+			w.newline(depth+1, false)
+		}
+		w.sb.WriteByte(']')
+	}
+	if w.indent == "" {
+		w.sb.WriteString(" }")
+	} else {
+		w.newline(depth, false)
+		w.sb.WriteByte('}')
+	}
+}
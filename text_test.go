@@ -0,0 +1,79 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"testing"
+)
+
+var textStrs = []string{
+	"", "x", "nil", "sub", "rel", "payload", "list", "//c", "a b", "a\nb\t\"c\"", "`q`",
+	"é😀", "1.5", "-2", "a@b.c", "$x+y", "bad \xff utf-8", "{}[]:;,#=",
+}
+
+func textSamples() []Meta {
+	ms := []Meta{
+		Nil,
+		New("A"),
+		New("Order", "place", "shop", "o-1").
+			WithTag("vip", "", "level", "2").
+			WithAttr("total", "12.5", "note", "a \"quoted\" note").
+			WithSub("customer", New("Customer", "", "crm").WithAttr("name", "Bob")).
+			WithRel("owner", New("User", "", "", "u1")).
+			WithList([]Meta{New("Item").WithAttr("qty", "2"), Nil, New("Item", "", "", "i-2")}, false),
+		New("Doc").WithBytesPayload([]byte{0x89, 'P', 'N', 'G', 0, '\n'}, "image/png"),
+		New("Doc").WithPayload("text\nwith `ticks`"),
+		New("Nest").WithSub("a", New("A").WithSub("b", New("B").WithList([]Meta{New("C").WithSub("d", New("D"))}))),
+		New("Empty").WithSub("none", Nil).WithRel("none", Nil),
+	}
+	for _, s := range textStrs {
+		m := New("Str").WithTag("t", s).WithAttr("a", s).WithSub("s", New("S")).WithPayload(s)
+		if s != "" {
+			m = m.WithTag(s, s).WithAttr(s, s).WithSub(s, New("S")).WithRel(s, New("R"))
+			if s != "nil" {
+				m = m.WithList([]Meta{New(s, s, s, s)})
+			}
+		}
+		ms = append(ms, m)
+	}
+	return ms
+}
+
+func TestTextRoundTrip(t *testing.T) {
+	for _, m := range textSamples() {
+		for _, s := range []string{FormatText(m), CompactText(m)} {
+			back, err := ParseText(s)
+			if err != nil {
+				t.Errorf("%s: %v", s, err)
+			} else if !Equal(back, m) || back.PayloadType() != m.PayloadType() || len(back.List()) != len(m.List()) {
+				t.Errorf("%s read back as %s", s, CanonicalJson(back))
+			}
+		}
+	}
+}
+
+func TestTextError(t *testing.T) {
+	for _, c := range []struct {
+		in        string
+		line, col int
+	}{
+		{"", 1, 1},
+		{"A {", 1, 4},
+		{"A [x=1, x=2]", 1, 9},
+		{"A {\n  a: 1\n  a: 2\n}", 3, 3},
+		{"A {\n  sub b: B\n  sub b: C\n}", 3, 3},
+		{"A {\n  a: \"open\n}", 2, 6},
+		{"A {\n  // comment\n  a: 1 }\nB", 4, 1},
+		{"A\n\n   {a:}", 3, 7},
+		{"é😀 {}", 1, 2}, // columns count runes
+		{"é {\n\t? }", 2, 2},
+		{"ns:", 1, 4},
+		{"A {\n  list: [B, C,\n", 3, 1},
+	} {
+		_, err := ParseText(c.in)
+		te, ok := err.(*TextError)
+		if !ok || te.Line != c.line || te.Col != c.col {
+			t.Errorf("%q: got %v, want %d:%d", c.in, err, c.line, c.col)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+var tomlLineError = regexp.MustCompile(`^toml: line \d+( \(last key "[^"]*"\))?: `)
+
+// ParseMetaToml reads a Meta from a TOML document. Its errors are
+// SourceErrors, with the line and column where the TOML library tells them.
+func ParseMetaToml(buf []byte) (Meta, error) {
+	var doc map[string]interface{}
+	if _, err := toml.Decode(string(buf), &doc); err != nil {
+		var pe toml.ParseError
+		if errors.As(err, &pe) {
+			line, col := pe.Position.Line, 0
+			if start := pe.Position.Start; start > 0 && start <= len(buf) || start == 0 && line == 1 {
+				line = 1 + bytes.Count(buf[:start], []byte{'\n'})
+				col = start - bytes.LastIndexByte(buf[:start], '\n')
+			}
+			msg := pe.Message
+			if msg == "" {
+				msg = tomlLineError.ReplaceAllString(err.Error(), "")
+			}
+			return Nil, &SourceError{Format: "toml", Line: line, Col: col, Msg: msg}
+		}
+		return Nil, err
+	}
+	if len(doc) == 0 {
+		return Nil, nil
+	}
+	m, err := tomlMeta(doc, nil, 0)
+	if pe, ok := err.(*tomlPathError); ok {
+		line, col := tomlPosition(buf, pe.path)
+		return Nil, &SourceError{Format: "toml", Line: line, Col: col, Path: pe.path.String(), Msg: pe.msg}
+	}
+	return m, err
+}
+
+// tomlPath is the path to a value, a key and the index in the array of
+// tables it names at each step, or -1
+type tomlPath []tomlStep
+
+type tomlStep struct {
+	key  string
+	item int
+}
+
+func (p tomlPath) key(key string) tomlPath {
+	return append(p[:len(p):len(p)], tomlStep{key, -1})
+}
+
+func (p tomlPath) item(key string, item int) tomlPath {
+	return append(p[:len(p):len(p)], tomlStep{key, item})
+}
+
+func (p tomlPath) String() string {
+	if len(p) == 0 {
+		return "top"
+	}
+	var sb strings.Builder
+	for i, step := range p {
+		if i > 0 {
+			sb.WriteString(".")
+		}
+		sb.WriteString(tomlKey(step.key))
+		if step.item >= 0 {
+			sb.WriteString("[" + strconv.Itoa(step.item) + "]")
+		}
+	}
+	return sb.String()
+}
+
+// tomlPathError is a SourceError before its position is looked up
+type tomlPathError struct {
+	path tomlPath
+	msg  string
+}
+
+func (e *tomlPathError) Error() string {
+	return e.path.String() + ": " + e.msg
+}
+
+func tomlError(path tomlPath, format string, args ...interface{}) error {
+	return &tomlPathError{path, fmt.Sprintf(format, args...)}
+}
+
+var tomlKeyLine = regexp.MustCompile(`^toml: line (\d+) `)
+
+// tomlPosition returns the line and column of the last key of path, or 0s.
+// The TOML library tells the line of a key only in errors, as that of a
+// type it cannot decode, and for an array of tables that of its last item.
+func tomlPosition(buf []byte, path tomlPath) (int, int) {
+	var top map[string]toml.Primitive
+	md, err := toml.Decode(string(buf), &top)
+	if err != nil || len(path) == 0 {
+		return 0, 0
+	}
+	var prim toml.Primitive
+	tables := top
+	for i, step := range path {
+		var ok bool
+		if prim, ok = tables[step.key]; !ok {
+			return 0, 0
+		}
+		if step.item >= 0 {
+			var items []map[string]toml.Primitive
+			if md.PrimitiveDecode(prim, &items) != nil || step.item != len(items)-1 {
+				return 0, 0
+			}
+			tables = items[step.item]
+		} else if i < len(path)-1 {
+			tables = nil
+			if md.PrimitiveDecode(prim, &tables) != nil {
+				return 0, 0
+			}
+		}
+	}
+
+	var probe chan int
+	err = md.PrimitiveDecode(prim, &probe)
+	sub := tomlKeyLine.FindStringSubmatch(fmt.Sprint(err))
+	if sub == nil {
+		return 0, 0
+	}
+	line, _ := strconv.Atoi(sub[1])
+	lines := bytes.Split(buf, []byte{'\n'})
+	if line < 1 || line > len(lines) {
+		return 0, 0
+	}
+	key := regexp.MustCompile(`(^|[\s.\[{,])(` + regexp.QuoteMeta(tomlKey(path[len(path)-1].key)) + `)\s*[.=\]]`)
+	if loc := key.FindSubmatchIndex(lines[line-1]); loc != nil {
+		return line, loc[4] + 1
+	}
+	return line, 0
+}
+
+func tomlMeta(doc map[string]interface{}, path tomlPath, depth int) (Meta, error) {
+	if depth > maxTextDepth {
+		return Nil, tomlError(path, "nested too deep")
+	}
+
+	b := &Builder{}
+	var payload, ctype, enc string
+	for _, key := range sortedKeys(doc) {
+		val, at := doc[key], path.key(key)
+		var err error
+		switch key {
+		case "kind":
+			b.kind, err = tomlStr(val, at)
+		case "method":
+			b.mthd, err = tomlStr(val, at)
+		case "ns":
+			b.ns, err = tomlStr(val, at)
+		case "gid":
+			b.gid, err = tomlStr(val, at)
+		case "payload":
+			payload, err = tomlStr(val, at)
+		case "payloadType":
+			ctype, err = tomlStr(val, at)
+		case "payloadEncoding":
+			enc, err = tomlStr(val, at)
+		case "tags", "attrs":
+			set := b.SetTag
+			if key == "attrs" {
+				set = b.SetAttr
+			}
+			err = tomlEach(val, at, func(name string, v interface{}) error {
+				s, err := tomlStr(v, at.key(name))
+				set(name, s)
+				return err
+			})
+		case "subs", "rels":
+			set := b.SetSub
+			if key == "rels" {
+				set = b.SetRel
+			}
+			err = tomlEach(val, at, func(name string, v interface{}) error {
+				sub, ok := v.(map[string]interface{})
+				if !ok {
+					return tomlError(at.key(name), "expected a table")
+				}
+				m, err := tomlMeta(sub, at.key(name), depth+1)
+				set(name, m)
+				return err
+			})
+		case "list":
+			items, ok := val.([]map[string]interface{})
+			if !ok {
+				if arr, isArr := val.([]interface{}); isArr && len(arr) == 0 {
+					break
+				}
+				return Nil, tomlError(at, "expected an array of tables")
+			}
+			for i, item := range items {
+				m, err := tomlMeta(item, path.item(key, i), depth+1)
+				if err != nil {
+					return Nil, err
+				}
+				if !m.IsNil() { // as JsonToMeta
+					b.AppendList(m)
+				}
+			}
+		default:
+			err = tomlError(at, "unknown field")
+		}
+		if err != nil {
+			return Nil, err
+		}
+	}
+	var err error
+	if b.payload, err = decodePayload(payload, ctype, enc); err != nil {
+		return Nil, tomlError(path.key("payload"), "payload: %v", err)
+	}
+	return b.Build(), nil
+}
+
+func tomlEach(val interface{}, path tomlPath, fn func(name string, v interface{}) error) error {
+	doc, ok := val.(map[string]interface{})
+	if !ok {
+		return tomlError(path, "expected a table")
+	}
+	for _, name := range sortedKeys(doc) {
+		if err := fn(name, doc[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tomlStr formats a scalar as a string; local dates and times keep their
+// form, and offset date-times are converted to UTC
+func tomlStr(val interface{}, path tomlPath) (string, error) {
+	switch v := val.(type) {
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case time.Time:
+		switch v.Location().String() {
+		case "date-local":
+			return v.Format(UtcDateFormat), nil
+		case "time-local":
+			return v.Format("15:04:05.999999999"), nil
+		case "datetime-local":
+			return v.Format("2006-01-02T15:04:05.999999999"), nil
+		}
+		if v = v.UTC(); v.Nanosecond()%int(time.Millisecond) == 0 {
+			return v.Format(UtcTimeFormat), nil
+		}
+		return v.Format(time.RFC3339Nano), nil
+	}
+	return "", tomlError(path, "expected a scalar")
+}
+
+// MetaToToml writes m as a TOML document, with all scalars as strings and
+// list items as an array of tables. A Nil Meta is an empty document.
+func MetaToToml(m Meta) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := toml.NewEncoder(&buf)
+	enc.Indent = ""
+	if err := enc.Encode(tomlDoc(orNil(m), map[Meta]bool{})); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func tomlDoc(m Meta, stack map[Meta]bool) map[string]interface{} {
+	doc := map[string]interface{}{}
+	if m.IsNil() {
+		return doc
+	}
+	if stack[m] {
+		m = Ref(m)
+	}
+	stack[m] = true
+	defer delete(stack, m)
+
+	payload, ctype, enc := encodePayload(m)
+	for key, val := range map[string]string{
+		"kind": m.Kind(), "method": m.Method(), "ns": m.Ns(), "gid": m.Gid(),
+		"payload": payload, "payloadType": ctype, "payloadEncoding": enc,
+	} {
+		if val != "" {
+			doc[key] = val
+		}
+	}
+	if names := m.TagNames(); len(names) > 0 {
+		tags := map[string]string{}
+		for _, name := range names {
+			tags[name] = m.Tag(name)
+		}
+		doc["tags"] = tags
+	}
+	if names := m.AttrNames(); len(names) > 0 {
+		attrs := map[string]string{}
+		for _, name := range names {
+			attrs[name] = m.Attr(name)
+		}
+		doc["attrs"] = attrs
+	}
+	nodes := func(key string, names []string, get func(string) Meta) {
+		if len(names) > 0 {
+			vals := map[string]interface{}{}
+			for _, name := range names {
+				vals[name] = tomlDoc(get(name), stack)
+			}
+			doc[key] = vals
+		}
+	}
+	nodes("subs", m.SubNames(), m.Sub)
+	nodes("rels", m.RelNames(), m.Rel)
+	if list := m.List(); len(list) > 0 {
+		items := make([]map[string]interface{}, len(list))
+		for i, item := range list {
+			items[i] = tomlDoc(item, stack)
+		}
+		doc["list"] = items
+	}
+	return doc
+}
+
+func sortedKeys(doc map[string]interface{}) []string {
+	keys := make([]string, 0, len(doc))
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// tomlKey quotes a key for messages if it is not bare
+func tomlKey(key string) string {
+	if key != "" && strings.Trim(key, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-") == "" {
+		return key
+	}
+	return strconv.Quote(key)
+}
@@ -0,0 +1,34 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"testing"
+)
+
+func TestParseMetaTomlErrors(t *testing.T) {
+	for _, c := range []struct {
+		in        string
+		line, col int
+		path      string
+	}{
+		{"kind = \"A\"\nattrs = 3\n", 2, 1, "attrs"},
+		{"kind = \"A\"\n[attrs]\nx = [1]\n", 3, 1, "attrs.x"},
+		{"kind = \"A\"\nattrs = {x = 1, y = [2]}\n", 2, 17, "attrs.y"},
+		{"kind = \"A\"\n[subs]\ncustomer = 3\n", 3, 1, "subs.customer"},
+		{"kind = \"A\"\n[subs.c]\nkind = \"C\"\n[subs.c.attrs]\n  \"a b\" = {}\n", 5, 3, `subs.c.attrs."a b"`},
+		{"kind = \"A\"\nbogus = 1\n", 2, 1, "bogus"},
+		{"kind = \"A\"\nlist = 3\n", 2, 1, "list"},
+		{"kind = \"A\"\npayload = \"!!\"\npayloadEncoding = \"base64\"\n", 2, 1, "payload"},
+		{"kind = \"A\"\n[[list]]\nkind = \"B\"\n[[list]]\nkind = \"C\"\nfoo = 1\n", 6, 1, "list[1].foo"},
+		// the TOML library tells the lines of the last item only
+		{"kind = \"A\"\n[[list]]\nkind = \"B\"\nfoo = 1\n[[list]]\nkind = \"C\"\n", 0, 0, "list[0].foo"},
+		{"kind = \"A\"\nattrs = {\n", 2, 10, ""},
+	} {
+		_, err := ParseMetaToml([]byte(c.in))
+		se, ok := err.(*SourceError)
+		if !ok || se.Line != c.line || se.Col != c.col || se.Path != c.path {
+			t.Errorf("%q: got %#v", c.in, err)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Typed JSON lets tags and attrs be JSON numbers, bools and null, as
+// clients in other languages like to send them. Reading them leniently
+// stores numbers as written, so 1.50 is "1.50" and 1e3 is "1e3", bools as
+// "true" and "false", and null as "". Schema.TypedJson writes as numbers
+// and bools only values that read back the same, so for any schema and
+// Meta, ParseMetaLenient of its TypedJson is Equal to the Meta, as
+// ParseMeta of its Json is. The other way, typed JSON read leniently and
+// written with TypedJson keeps the numbers as written and the bools of
+// declared fields, but null becomes "" and other fields strings.
+
+// ParseMetaLenient is ParseMeta but takes numbers, bools and null for tags
+// and attrs; Decoder.Lenient does the same for streams.
+func ParseMetaLenient(buf []byte) (Meta, error) {
+	var lj lenientJson
+	if err := json.Unmarshal(buf, &lj); err != nil {
+		return Nil, err
+	}
+	mj := lj.metaJson()
+	if err := mj.checkPayloads(); err != nil {
+		return Nil, err
+	}
+	return JsonToMeta(mj), nil
+}
+
+type lenientJson struct {
+	Kind            string                 `json:"kind,omitempty"`
+	Method          string                 `json:"method,omitempty"`
+	Ns              string                 `json:"ns,omitempty"`
+	Gid             string                 `json:"gid,omitempty"`
+	Tags            map[string]jsonScalar  `json:"tags,omitempty"`
+	Attrs           map[string]jsonScalar  `json:"attrs,omitempty"`
+	Payload         string                 `json:"payload,omitempty"`
+	PayloadType     string                 `json:"payloadType,omitempty"`
+	PayloadEncoding string                 `json:"payloadEncoding,omitempty"`
+	Subs            map[string]lenientJson `json:"subs,omitempty"`
+	Rels            map[string]lenientJson `json:"rels,omitempty"`
+	List            []lenientJson          `json:"list,omitempty"`
+}
+
+func (lj lenientJson) metaJson() MetaJson {
+	mj := MetaJson{
+		Kind:            lj.Kind,
+		Method:          lj.Method,
+		Ns:              lj.Ns,
+		Gid:             lj.Gid,
+		Tags:            scalarStrings(lj.Tags),
+		Attrs:           scalarStrings(lj.Attrs),
+		Payload:         lj.Payload,
+		PayloadType:     lj.PayloadType,
+		PayloadEncoding: lj.PayloadEncoding,
+		Subs:            lenientJsons(lj.Subs),
+		Rels:            lenientJsons(lj.Rels),
+	}
+	if len(lj.List) > 0 {
+		mj.List = make([]MetaJson, len(lj.List))
+		for i, item := range lj.List {
+			mj.List[i] = item.metaJson()
+		}
+	}
+	return mj
+}
+
+func lenientJsons(ljs map[string]lenientJson) map[string]MetaJson {
+	if len(ljs) == 0 {
+		return nil
+	}
+	ret := make(map[string]MetaJson, len(ljs))
+	for name, lj := range ljs {
+		ret[name] = lj.metaJson()
+	}
+	return ret
+}
+
+// jsonScalar is a string read from a JSON string, number, bool or null
+type jsonScalar string
+
+func (v *jsonScalar) UnmarshalJSON(buf []byte) error {
+	s, err := scalarString(buf)
+	*v = jsonScalar(s)
+	return err
+}
+
+func scalarString(buf []byte) (string, error) {
+	switch buf[0] {
+	case '"':
+		var s string
+		err := json.Unmarshal(buf, &s)
+		return s, err
+	case '{', '[':
+		return "", fmt.Errorf("Invalid json tag or attr %.20s: expected a string, number, bool or null", buf)
+	case 'n':
+		return "", nil
+	}
+	return string(buf), nil
+}
+
+func scalarStrings(vals map[string]jsonScalar) map[string]string {
+	if len(vals) == 0 {
+		return nil
+	}
+	ret := make(map[string]string, len(vals))
+	for name, val := range vals {
+		ret[name] = string(val)
+	}
+	return ret
+}
+
+// TypedJson writes m as JSON with the tags and attrs declared int, float or
+// bool, in m and in nodes the schema reaches, as JSON numbers and bools if
+// that reads back the same, and as strings otherwise: "007" and "1e400"
+// stay strings, and so does "yes" although a valid bool.
+func (s *Schema) TypedJson(m Meta) ([]byte, error) {
+	return json.Marshal(s.typedJson(orNil(m), map[Meta]bool{}))
+}
+
+type typedJson struct {
+	Kind            string                 `json:"kind,omitempty"`
+	Method          string                 `json:"method,omitempty"`
+	Ns              string                 `json:"ns,omitempty"`
+	Gid             string                 `json:"gid,omitempty"`
+	Tags            map[string]interface{} `json:"tags,omitempty"`
+	Attrs           map[string]interface{} `json:"attrs,omitempty"`
+	Payload         string                 `json:"payload,omitempty"`
+	PayloadType     string                 `json:"payloadType,omitempty"`
+	PayloadEncoding string                 `json:"payloadEncoding,omitempty"`
+	Subs            map[string]typedJson   `json:"subs,omitempty"`
+	Rels            map[string]typedJson   `json:"rels,omitempty"`
+	List            []typedJson            `json:"list,omitempty"`
+}
+
+// typedJson converts m with s, which may be nil, as metaToJson does
+func (s *Schema) typedJson(m Meta, stack map[Meta]bool) typedJson {
+	if m.IsNil() {
+		return typedJson{}
+	}
+	if stack[m] {
+		m = Ref(m)
+	}
+	stack[m] = true
+	defer delete(stack, m)
+
+	if s != nil && s.kind != "" && m.Kind() != s.kind {
+		s = nil
+	}
+	tj := typedJson{
+		Kind:   m.Kind(),
+		Method: m.Method(),
+		Ns:     m.Ns(),
+		Gid:    m.Gid(),
+	}
+	tj.Payload, tj.PayloadType, tj.PayloadEncoding = encodePayload(m)
+
+	var tags, attrs []*fieldSchema
+	var subs, rels []*nodeSchema
+	var list *Schema
+	if s != nil {
+		tags, attrs, subs, rels = s.tags, s.attrs, s.subs, s.rels
+		if s.list != nil {
+			list = s.list.schema
+		}
+	}
+	tj.Tags = typedValues(tags, m.TagNames(), m.Tag)
+	tj.Attrs = typedValues(attrs, m.AttrNames(), func(name string) string { return m.Attr(name) })
+	tj.Subs = typedNodes(subs, m.SubNames(), m.Sub, stack)
+	tj.Rels = typedNodes(rels, m.RelNames(), m.Rel, stack)
+	if items := m.List(); len(items) > 0 {
+		tj.List = make([]typedJson, len(items))
+		for i, item := range items {
+			tj.List[i] = list.typedJson(orNil(item), stack)
+		}
+	}
+	return tj
+}
+
+func typedValues(fields []*fieldSchema, names []string, get func(string) string) map[string]interface{} {
+	if len(names) == 0 {
+		return nil
+	}
+	types := make(map[string]string, len(fields))
+	for _, f := range fields {
+		types[f.name] = f.typ
+	}
+	ret := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		ret[name] = typedValue(types[name], get(name))
+	}
+	return ret
+}
+
+// typedValue returns val as a json.Number or bool if typ allows and it
+// reads back as val
+func typedValue(typ, val string) interface{} {
+	switch typ {
+	case "int", "float":
+		if isJsonNumber(val) && (typ == "float" || isInt(val)) {
+			return json.Number(val)
+		}
+	case "bool":
+		if val == "true" || val == "false" {
+			return val == "true"
+		}
+	}
+	return val
+}
+
+func isInt(val string) bool {
+	_, err := strconv.Atoi(val)
+	return err == nil
+}
+
+// isJsonNumber checks the JSON number syntax, which is stricter than Go's
+// and has no leading zeros, and that the value is finite
+func isJsonNumber(s string) bool {
+	i := 0
+	digits := func() int {
+		start := i
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		return i - start
+	}
+	if i < len(s) && s[i] == '-' {
+		i++
+	}
+	if n := digits(); n == 0 || n > 1 && s[i-n] == '0' {
+		return false
+	}
+	if i < len(s) && s[i] == '.' {
+		i++
+		if digits() == 0 {
+			return false
+		}
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		i++
+		if i < len(s) && (s[i] == '+' || s[i] == '-') {
+			i++
+		}
+		if digits() == 0 {
+			return false
+		}
+	}
+	if i != len(s) {
+		return false
+	}
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
+
+func typedNodes(nodes []*nodeSchema, names []string, get func(string) Meta, stack map[Meta]bool) map[string]typedJson {
+	if len(names) == 0 {
+		return nil
+	}
+	schemas := make(map[string]*Schema, len(nodes))
+	for _, n := range nodes {
+		schemas[n.name] = n.schema
+	}
+	ret := make(map[string]typedJson, len(names))
+	for _, name := range names {
+		ret[name] = schemas[name].typedJson(get(name), stack)
+	}
+	return ret
+}
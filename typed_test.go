@@ -0,0 +1,88 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"testing"
+)
+
+var typedSchema = MustCompileSchema(New("Schema").WithTag("kind", "Item").WithList([]Meta{
+	New("Attr").WithAttr("name", "count", "type", "int"),
+	New("Attr").WithAttr("name", "price", "type", "float"),
+	New("Attr").WithAttr("name", "done", "type", "bool"),
+	New("Tag").WithAttr("name", "rank", "type", "int"),
+	New("Sub").WithAttr("name", "part").WithSub("schema", New("Schema").WithList([]Meta{
+		New("Attr").WithAttr("name", "weight", "type", "float"),
+	})),
+}))
+
+var typedSamples = []string{
+	"0", "-0", "007", "42", "-12", "1.50", "1e3", "1E+3", "0.1", "1e400", "-1e-400",
+	"9223372036854775808", ".5", "5.", "+1", "0x10", "NaN", "Inf",
+	"true", "false", "yes", "True", "1", "", "abc", " 1",
+}
+
+// ParseMetaLenient reads back what TypedJson writes, for any values of
+// declared and undeclared fields
+func TestTypedJsonRoundTrip(t *testing.T) {
+	for _, val := range typedSamples {
+		m := New("Item").
+			WithAttr("count", val, "price", val, "done", val, "other", val).
+			WithTag("rank", val).
+			WithSub("part", New("Part").WithAttr("weight", val))
+		buf, err := typedSchema.TypedJson(m)
+		if err != nil {
+			t.Fatalf("%q: %v", val, err)
+		}
+		back, err := ParseMetaLenient(buf)
+		if err != nil {
+			t.Fatalf("%q: %s: %v", val, buf, err)
+		}
+		if !Equal(back, m) {
+			t.Errorf("%q: %s read back as %s", val, buf, CanonicalJson(back))
+		}
+	}
+}
+
+func TestTypedJsonValues(t *testing.T) {
+	m := New("Item").WithAttr("count", "007", "price", "1.50", "done", "yes", "other", "3").WithTag("rank", "1e400")
+	buf, err := typedSchema.TypedJson(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"kind":"Item","tags":{"rank":"1e400"},"attrs":{"count":"007","done":"yes","other":"3","price":1.50}}`
+	if string(buf) != want {
+		t.Errorf("got %s, want %s", buf, want)
+	}
+}
+
+// Lenient reading keeps numbers as written, so TypedJson writes them back
+// the same
+func TestParseMetaLenient(t *testing.T) {
+	in := `{"kind":"Item","tags":{"rank":-0},"attrs":{"count":7,"price":1.50,"big":1e3,"done":true,"other":null}}`
+	m, err := ParseMetaLenient([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"count": "7", "price": "1.50", "big": "1e3", "done": "true", "other": ""} {
+		if got, ok := m.AttrOk(name); !ok || got != want {
+			t.Errorf("attr %s = %q, want %q", name, got, want)
+		}
+	}
+	if got := m.Tag("rank"); got != "-0" {
+		t.Errorf("tag rank = %q, want %q", got, "-0")
+	}
+
+	buf, err := typedSchema.TypedJson(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"kind":"Item","tags":{"rank":-0},"attrs":{"big":"1e3","count":7,"done":true,"other":"","price":1.50}}`
+	if string(buf) != want {
+		t.Errorf("got %s, want %s", buf, want)
+	}
+
+	if _, err := ParseMetaLenient([]byte(`{"kind":"Item","attrs":{"a":[1]}}`)); err == nil {
+		t.Error("array attr accepted")
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+type WalkAction int
+
+const (
+	WalkContinue WalkAction = iota
+	WalkSkip                // skip the subtree (or, from OnSub etc., the child)
+	WalkStop                // abort the whole walk
+)
+
+// Visitor receives the path of the node being visited in every callback.
+// OnSub, OnRel and OnListItem are called before the child is walked, and may
+// skip it or stop the walk.
+type Visitor interface {
+	BeginMeta(p Path, m Meta) WalkAction
+	OnTag(p Path, m Meta, name, value string)
+	OnAttr(p Path, m Meta, name, value string)
+	OnPayload(p Path, m Meta, payload string)
+	OnSub(p Path, m Meta, name string, sub Meta) WalkAction
+	OnRel(p Path, m Meta, name string, rel Meta) WalkAction
+	OnListItem(p Path, m Meta, index int, item Meta) WalkAction
+	EndMeta(p Path, m Meta)
+}
+
+// BaseVisitor does nothing; embed it to implement only some callbacks.
+type BaseVisitor struct{}
+
+func (BaseVisitor) BeginMeta(p Path, m Meta) WalkAction                    { return WalkContinue }
+func (BaseVisitor) OnTag(p Path, m Meta, name, value string)               {}
+func (BaseVisitor) OnAttr(p Path, m Meta, name, value string)              {}
+func (BaseVisitor) OnPayload(p Path, m Meta, payload string)               {}
+func (BaseVisitor) OnSub(p Path, m Meta, name string, sub Meta) WalkAction { return WalkContinue }
+func (BaseVisitor) OnRel(p Path, m Meta, name string, rel Meta) WalkAction { return WalkContinue }
+func (BaseVisitor) OnListItem(p Path, m Meta, i int, item Meta) WalkAction { return WalkContinue }
+func (BaseVisitor) EndMeta(p Path, m Meta)                                 {}
+
+// Walk visits m and its subs, rels and list items depth-first, calling
+// BeginMeta, then the tags, attrs and payload, then the children and finally
+// EndMeta (also when BeginMeta skips). A node already on the current path
+// is not walked again, so cycles are safe. It returns false if the walk was
+// stopped.
+func Walk(m Meta, v Visitor) bool {
+	return walker{v, false, map[Meta]bool{}}.walk(Path{}, orNil(m)) != WalkStop
+}
+
+// WalkPostOrder is like Walk but visits the children before calling
+// BeginMeta, tags, attrs, payload and EndMeta of a node, so WalkSkip from
+// BeginMeta has no effect.
+func WalkPostOrder(m Meta, v Visitor) bool {
+	return walker{v, true, map[Meta]bool{}}.walk(Path{}, orNil(m)) != WalkStop
+}
+
+type walker struct {
+	v     Visitor
+	post  bool
+	stack map[Meta]bool // nodes on the current path, to break cycles
+}
+
+func (w walker) walk(p Path, m Meta) WalkAction {
+	v, post := w.v, w.post
+	w.stack[m] = true
+	defer delete(w.stack, m)
+
+	if !post {
+		if act := visitNode(p, m, v); act != WalkContinue {
+			if act == WalkSkip {
+				v.EndMeta(p, m)
+				return WalkContinue
+			}
+			return act
+		}
+	}
+
+	for _, name := range m.SubNames() {
+		sub := m.Sub(name)
+		if w.walkChild(v.OnSub(p, m, name, sub), p.Child(PathStep{Axis: AxisSub, Name: name}), sub) == WalkStop {
+			return WalkStop
+		}
+	}
+	for _, name := range m.RelNames() {
+		rel := m.Rel(name)
+		if w.walkChild(v.OnRel(p, m, name, rel), p.Child(PathStep{Axis: AxisRel, Name: name}), rel) == WalkStop {
+			return WalkStop
+		}
+	}
+	for idx, item := range m.List() {
+		if w.walkChild(v.OnListItem(p, m, idx, item), p.Child(PathStep{Axis: AxisList, Index: idx}), item) == WalkStop {
+			return WalkStop
+		}
+	}
+
+	if post && visitNode(p, m, v) == WalkStop {
+		return WalkStop
+	}
+	v.EndMeta(p, m)
+	return WalkContinue
+}
+
+// walkChild walks m unless skipped, or already on the path (a cycle)
+func (w walker) walkChild(act WalkAction, p Path, m Meta) WalkAction {
+	if act != WalkContinue {
+		if act == WalkSkip {
+			return WalkContinue
+		}
+		return act
+	}
+	if w.stack[m] {
+		return WalkContinue
+	}
+	return w.walk(p, m)
+}
+
+// visitNode reports the node itself, unless BeginMeta skips or stops
+func visitNode(p Path, m Meta, v Visitor) WalkAction {
+	if act := v.BeginMeta(p, m); act != WalkContinue {
+		return act
+	}
+	for _, name := range m.TagNames() {
+		v.OnTag(p, m, name, m.Tag(name))
+	}
+	for _, name := range m.AttrNames() {
+		v.OnAttr(p, m, name, m.Attr(name))
+	}
+	if payload := m.Payload(); payload != "" {
+		v.OnPayload(p, m, payload)
+	}
+	return WalkContinue
+}
+
+// WalkFunc calls fn for m and every node below it in pre-order.
+func WalkFunc(m Meta, fn func(p Path, m Meta) WalkAction) bool {
+	return Walk(m, funcVisitor{fn: fn})
+}
+
+type funcVisitor struct {
+	BaseVisitor
+	fn func(p Path, m Meta) WalkAction
+}
+
+func (v funcVisitor) BeginMeta(p Path, m Meta) WalkAction {
+	return v.fn(p, m)
+}
+
+// Transform rebuilds m bottom-up: every node, with its children already
+// transformed, is replaced by fn(path, node). Returning Nil removes the node
+// from its parent; untouched subtrees are shared with m.
+func Transform(m Meta, fn func(p Path, m Meta) Meta) Meta {
+	return transform(Path{}, orNil(m), fn)
+}
+
+func transform(p Path, m Meta, fn func(p Path, m Meta) Meta) Meta {
+	if m.IsNil() {
+		return orNil(fn(p, m))
+	}
+
+	ret := m
+	for _, name := range m.SubNames() {
+		sub := m.Sub(name)
+		if n := transform(p.Child(PathStep{Axis: AxisSub, Name: name}), sub, fn); n != sub {
+			if n.IsNil() {
+				ret = ret.WithoutSub(name)
+			} else {
+				ret = ret.WithSub(name, n)
+			}
+		}
+	}
+	for _, name := range m.RelNames() {
+		rel := m.Rel(name)
+		if n := transform(p.Child(PathStep{Axis: AxisRel, Name: name}), rel, fn); n != rel {
+			if n.IsNil() {
+				ret = ret.WithoutRel(name)
+			} else {
+				ret = ret.WithRel(name, n)
+			}
+		}
+	}
+
+	list := m.List()
+	var newList []Meta
+	for idx, item := range list {
+		n := transform(p.Child(PathStep{Axis: AxisList, Index: idx}), item, fn)
+		if n != item && newList == nil {
+			newList = append(make([]Meta, 0, len(list)), list[:idx]...)
+		}
+		if newList != nil && !n.IsNil() {
+			newList = append(newList, n)
+		}
+	}
+	if newList != nil {
+		ret = ret.WithList(newList)
+	}
+
+	return orNil(fn(p, ret))
+}
@@ -0,0 +1,468 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// In XML a Meta is an element named by its kind, in the default namespace
+// given by its ns, with the method and gid as attributes mp.method and
+// mp.gid and the payload as its character data, base64 for bytes with
+// attributes mp.payloadType and mp.payloadEncoding as in MetaJson:
+//
+//	<Order xmlns="shop" mp.method="place" mp.gid="o1" mp.tag.vip="" total="12.5">
+//	  <mp.sub name="customer"><Customer name="Bob"/></mp.sub>
+//	  <mp.rel name="owner"><Customer name="Bob"/></mp.rel>
+//	  <Item sku="007"/>
+//	</Order>
+//
+// Tags are attributes prefixed with mp.tag. and attrs plain attributes, or
+// child elements <mp.tag name="vip"></mp.tag> and <mp.attr name="total">12.5
+// </mp.attr> as configured; a name that is not a valid XML name, starts
+// with "xml", or an attr name starting with "mp.", is always a child
+// element. Subs and rels are wrapped in named mp.sub and mp.rel elements,
+// list items are the other child elements, and a Nil Meta is <mp.nil/>. A
+// kind that cannot be an element name is written <mp.node mp.kind="...">.
+//
+// Whitespace between child elements is not part of the payload, so Encode
+// fails on a payload of only whitespace if the Meta has children, as it does
+// on strings with characters not allowed in XML or invalid UTF-8.
+
+const xmlPrefix = "mp."
+
+// XmlCodec encodes Metas to XML and decodes them back. Decoding accepts
+// both forms of tags and attrs.
+type XmlCodec struct {
+	TagElems  bool   // tags as <mp.tag> elements
+	AttrElems bool   // attrs as <mp.attr> elements
+	Indent    string // indent of nested elements if set
+}
+
+func EncodeXml(m Meta) ([]byte, error) {
+	return (&XmlCodec{}).Encode(m)
+}
+
+func DecodeXml(buf []byte) (Meta, error) {
+	return (&XmlCodec{}).Decode(buf)
+}
+
+func (c *XmlCodec) Encode(m Meta) ([]byte, error) {
+	var buf bytes.Buffer
+	w := &xmlWriter{c, xml.NewEncoder(&buf), &buf}
+	if err := w.node(orNil(m), "", 0, map[Meta]bool{}); err != nil {
+		return nil, err
+	}
+	if err := w.enc.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type xmlWriter struct {
+	c   *XmlCodec
+	enc *xml.Encoder
+	buf *bytes.Buffer
+}
+
+func xmlAttr(name, value string) xml.Attr {
+	return xml.Attr{Name: xml.Name{Local: name}, Value: value}
+}
+
+func (w *xmlWriter) indent(depth int) error {
+	if w.c.Indent == "" {
+		return nil
+	}
+	// written raw, as CharData would escape tabs
+	if err := w.enc.Flush(); err != nil {
+		return err
+	}
+	w.buf.WriteString("\n" + strings.Repeat(w.c.Indent, depth))
+	return nil
+}
+
+// named writes a <mp.sub>, <mp.rel>, <mp.tag> or <mp.attr> element around
+// a node or a value
+func (w *xmlWriter) named(local, name string, content func() error) error {
+	start := xml.StartElement{Name: xml.Name{Local: xmlPrefix + local}, Attr: []xml.Attr{xmlAttr("name", name)}}
+	if err := w.enc.EncodeToken(start); err != nil {
+		return err
+	}
+	if err := content(); err != nil {
+		return err
+	}
+	return w.enc.EncodeToken(start.End())
+}
+
+// node writes m at depth, in the default namespace ns of its parent; a node
+// already on the path (a cycle) is written as a Ref
+func (w *xmlWriter) node(m Meta, ns string, depth int, stack map[Meta]bool) error {
+	if m.IsNil() {
+		start := xml.StartElement{Name: xml.Name{Local: xmlPrefix + "nil"}}
+		if err := w.enc.EncodeToken(start); err != nil {
+			return err
+		}
+		return w.enc.EncodeToken(start.End())
+	}
+	if stack[m] {
+		m = Ref(m)
+	}
+	stack[m] = true
+	defer delete(stack, m)
+	if err := checkXmlNode(m); err != nil {
+		return err
+	}
+
+	start := xml.StartElement{Name: xml.Name{Local: m.Kind()}}
+	if !isXmlName(m.Kind()) || strings.HasPrefix(m.Kind(), xmlPrefix) {
+		start.Name.Local = xmlPrefix + "node"
+		start.Attr = append(start.Attr, xmlAttr(xmlPrefix+"kind", m.Kind()))
+	}
+	if m.Ns() != ns {
+		start.Attr = append(start.Attr, xmlAttr("xmlns", m.Ns()))
+	}
+	if mthd := m.Method(); mthd != "" {
+		start.Attr = append(start.Attr, xmlAttr(xmlPrefix+"method", mthd))
+	}
+	if gid := m.Gid(); gid != "" {
+		start.Attr = append(start.Attr, xmlAttr(xmlPrefix+"gid", gid))
+	}
+	payload, ctype, enc := encodePayload(m)
+	if ctype != "" {
+		start.Attr = append(start.Attr, xmlAttr(xmlPrefix+"payloadType", ctype), xmlAttr(xmlPrefix+"payloadEncoding", enc))
+	}
+
+	var children []func(depth int) error
+	value := func(local, name, val string) func(int) error {
+		return func(int) error {
+			return w.named(local, name, func() error {
+				return w.enc.EncodeToken(xml.CharData(val))
+			})
+		}
+	}
+	for _, name := range m.TagNames() {
+		if !w.c.TagElems && isXmlName(name) {
+			start.Attr = append(start.Attr, xmlAttr(xmlPrefix+"tag."+name, m.Tag(name)))
+		} else {
+			children = append(children, value("tag", name, m.Tag(name)))
+		}
+	}
+	for _, name := range m.AttrNames() {
+		if !w.c.AttrElems && isXmlName(name) && !strings.HasPrefix(name, xmlPrefix) {
+			start.Attr = append(start.Attr, xmlAttr(name, m.Attr(name)))
+		} else {
+			children = append(children, value("attr", name, m.Attr(name)))
+		}
+	}
+	nodes := func(local string, names []string, get func(string) Meta) {
+		for _, name := range names {
+			name, item := name, get(name)
+			children = append(children, func(depth int) error {
+				return w.named(local, name, func() error {
+					if err := w.indent(depth + 1); err != nil {
+						return err
+					}
+					if err := w.node(item, m.Ns(), depth+1, stack); err != nil {
+						return err
+					}
+					return w.indent(depth)
+				})
+			})
+		}
+	}
+	nodes("sub", m.SubNames(), m.Sub)
+	nodes("rel", m.RelNames(), m.Rel)
+	for _, item := range m.List() {
+		if item != nil && !item.IsNil() { // as JsonToMeta
+			item := item
+			children = append(children, func(depth int) error {
+				return w.node(item, m.Ns(), depth, stack)
+			})
+		}
+	}
+
+	if len(children) > 0 && payload != "" && strings.TrimSpace(payload) == "" {
+		return fmt.Errorf("Invalid XML payload of only whitespace in %s with child elements", m.Kind())
+	}
+	if err := w.enc.EncodeToken(start); err != nil {
+		return err
+	}
+	if payload != "" {
+		if err := w.enc.EncodeToken(xml.CharData(payload)); err != nil {
+			return err
+		}
+	}
+	for _, child := range children {
+		if payload == "" {
+			if err := w.indent(depth + 1); err != nil {
+				return err
+			}
+		}
+		if err := child(depth + 1); err != nil {
+			return err
+		}
+	}
+	if payload == "" && len(children) > 0 {
+		if err := w.indent(depth); err != nil {
+			return err
+		}
+	}
+	return w.enc.EncodeToken(start.End())
+}
+
+// checkXmlNode reports the first string of m, but not of its subs, rels and
+// list items, that would not read back the same
+func checkXmlNode(m Meta) error {
+	strs := []string{m.Kind(), m.Method(), m.Ns(), m.Gid()}
+	if m.PayloadType() == "" { // bytes in base64
+		strs = append(strs, m.Payload())
+	}
+	for _, name := range m.TagNames() {
+		strs = append(strs, name, m.Tag(name))
+	}
+	for _, name := range m.AttrNames() {
+		strs = append(strs, name, m.Attr(name))
+	}
+	strs = append(strs, m.SubNames()...)
+	strs = append(strs, m.RelNames()...)
+	for _, s := range strs {
+		if !isXmlText(s) {
+			return fmt.Errorf("Invalid XML text %q in %s", s, m.Kind())
+		}
+	}
+	return nil
+}
+
+// isXmlText reports whether s is valid UTF-8 of characters allowed in XML
+func isXmlText(s string) bool {
+	for i, r := range s {
+		if r == utf8.RuneError {
+			if _, n := utf8.DecodeRuneInString(s[i:]); n == 1 {
+				return false
+			}
+		}
+		if !(r == '\t' || r == '\n' || r == '\r' || r >= 0x20 && r <= 0xD7FF ||
+			r >= 0xE000 && r <= 0xFFFD || r >= 0x10000 && r <= 0x10FFFF) {
+			return false
+		}
+	}
+	return true
+}
+
+// isXmlName reports whether s can be an element or attribute name without
+// a namespace prefix, and is not reserved
+func isXmlName(s string) bool {
+	if s == "" || len(s) >= 3 && strings.EqualFold(s[:3], "xml") {
+		return false
+	}
+	for i, r := range s {
+		if !unicode.IsLetter(r) && r != '_' && (i == 0 || !unicode.IsDigit(r) && r != '.' && r != '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Decode reads the only element in buf; attributes in other namespaces are
+// ignored.
+func (c *XmlCodec) Decode(buf []byte) (Meta, error) {
+	r := &xmlReader{xml.NewDecoder(bytes.NewReader(buf)), buf}
+	var m Meta
+	found := false
+	for {
+		tok, err := r.token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return Nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if found {
+				return Nil, r.errorf("more than one root element")
+			}
+			if m, err = r.node(t, 0); err != nil {
+				return Nil, err
+			}
+			found = true
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				return Nil, r.errorf("text outside the root element")
+			}
+		}
+	}
+	if !found {
+		return Nil, r.errorf("no root element")
+	}
+	return m, nil
+}
+
+type xmlReader struct {
+	d   *xml.Decoder
+	buf []byte
+}
+
+func (r *xmlReader) errorf(format string, args ...interface{}) error {
+	off := int(r.d.InputOffset())
+	if off > len(r.buf) {
+		off = len(r.buf)
+	}
+	line := 1 + bytes.Count(r.buf[:off], []byte{'\n'})
+	col := off - bytes.LastIndexByte(r.buf[:off], '\n')
+	return &SourceError{Format: "xml", Line: line, Col: col, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (r *xmlReader) token() (xml.Token, error) {
+	tok, err := r.d.Token()
+	var se *xml.SyntaxError
+	if errors.As(err, &se) {
+		return nil, &SourceError{Format: "xml", Line: se.Line, Msg: se.Msg}
+	}
+	return tok, err
+}
+
+// content reads up to the end of the current element, calling elem for
+// each child element, and returns the character data
+func (r *xmlReader) content(elem func(xml.StartElement) error) (string, error) {
+	var text []byte
+	for {
+		tok, err := r.token()
+		if err != nil {
+			if err == io.EOF {
+				err = r.errorf("unexpected end")
+			}
+			return "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if err := elem(t); err != nil {
+				return "", err
+			}
+		case xml.EndElement:
+			return string(text), nil
+		case xml.CharData:
+			text = append(text, t...)
+		}
+	}
+}
+
+func (r *xmlReader) name(start xml.StartElement) (string, error) {
+	for _, a := range start.Attr {
+		if a.Name.Space == "" && a.Name.Local == "name" {
+			return a.Value, nil
+		}
+	}
+	return "", r.errorf("%s without name", start.Name.Local)
+}
+
+func (r *xmlReader) node(start xml.StartElement, depth int) (Meta, error) {
+	if depth > maxTextDepth {
+		return Nil, r.errorf("nested too deep")
+	}
+	local := start.Name.Local
+	if local == xmlPrefix+"nil" {
+		return Nil, r.d.Skip()
+	}
+	if strings.HasPrefix(local, xmlPrefix) && local != xmlPrefix+"node" {
+		return Nil, r.errorf("unexpected element %s", local)
+	}
+
+	b := &Builder{kind: local, ns: start.Name.Space}
+	if local == xmlPrefix+"node" {
+		b.kind = ""
+	}
+	var ctype, enc string
+	for _, a := range start.Attr {
+		name := a.Name.Local
+		switch {
+		case a.Name.Space != "" || name == "xmlns":
+		case name == xmlPrefix+"kind" && local == xmlPrefix+"node":
+			b.kind = a.Value
+		case name == xmlPrefix+"method":
+			b.mthd = a.Value
+		case name == xmlPrefix+"gid":
+			b.gid = a.Value
+		case name == xmlPrefix+"payloadType":
+			ctype = a.Value
+		case name == xmlPrefix+"payloadEncoding":
+			enc = a.Value
+		case strings.HasPrefix(name, xmlPrefix+"tag."):
+			b.SetTag(name[len(xmlPrefix+"tag."):], a.Value)
+		case strings.HasPrefix(name, xmlPrefix):
+			return Nil, r.errorf("unexpected attribute %s", name)
+		default:
+			b.SetAttr(name, a.Value)
+		}
+	}
+	if b.kind == "" {
+		return Nil, r.errorf("%s without %skind", local, xmlPrefix)
+	}
+
+	hasChild := false
+	payload, err := r.content(func(child xml.StartElement) error {
+		hasChild = true
+		switch child.Name.Local {
+		case xmlPrefix + "tag", xmlPrefix + "attr":
+			name, err := r.name(child)
+			if err != nil {
+				return err
+			}
+			val, err := r.content(func(xml.StartElement) error {
+				return r.errorf("unexpected element in %s", child.Name.Local)
+			})
+			if child.Name.Local == xmlPrefix+"tag" {
+				b.SetTag(name, val)
+			} else {
+				b.SetAttr(name, val)
+			}
+			return err
+		case xmlPrefix + "sub", xmlPrefix + "rel":
+			name, err := r.name(child)
+			if err != nil {
+				return err
+			}
+			var sub Meta
+			text, err := r.content(func(elem xml.StartElement) error {
+				if sub != nil {
+					return r.errorf("more than one element in %s", child.Name.Local)
+				}
+				sub, err = r.node(elem, depth+1)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if strings.TrimSpace(text) != "" {
+				return r.errorf("text in %s", child.Name.Local)
+			}
+			if child.Name.Local == xmlPrefix+"sub" {
+				b.SetSub(name, orNil(sub))
+			} else {
+				b.SetRel(name, orNil(sub))
+			}
+			return nil
+		}
+		item, err := r.node(child, depth+1)
+		if err == nil && !item.IsNil() { // as JsonToMeta
+			b.AppendList(item)
+		}
+		return err
+	})
+	if err != nil {
+		return Nil, err
+	}
+	if hasChild && strings.TrimSpace(payload) == "" {
+		payload = ""
+	}
+	if b.payload, err = decodePayload(payload, ctype, enc); err != nil {
+		return Nil, r.errorf("payload: %v", err)
+	}
+	return b.Build(), nil
+}
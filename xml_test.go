@@ -0,0 +1,83 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"strings"
+	"testing"
+)
+
+var xmlTexts = []string{"", " ", "a\tb\nc\r\nd\r", "<&>\"'", "  padded  ", "�", "é😀", "]]>"}
+
+func xmlSamples() []Meta {
+	ms := []Meta{
+		Nil,
+		New("Order", "place", "shop", "o-1").
+			WithSub("customer", New("Customer", "", "crm").WithAttr("name", "Bob")).
+			WithRel("owner", New("User")).
+			WithList([]Meta{New("Item").WithAttr("sku", "007"), New("Item", "", "")}),
+		New("1Kind").WithTag("1tag", "v", "xmlTag", "w").WithAttr("mp.attr", "x", "a b", "y"),
+		New("mp.node").WithSub("a b", New("A")).WithRel("", New("B")),
+		New("Doc").WithBytesPayload([]byte{0, 1, 0xff}, "image/png").WithList([]Meta{New("A")}),
+		New("Doc").WithPayload(" text with children ").WithSub("s", New("S")),
+		New("Doc").WithPayload("   "),
+	}
+	for _, s := range xmlTexts {
+		m := New("Text", s, "", s).WithTag("t", s).WithAttr("a", s)
+		if strings.TrimSpace(s) != "" { // lost with tag or attr elements
+			m = m.WithPayload(s)
+		}
+		ms = append(ms, m, New("Text").WithPayload(s))
+	}
+	return ms
+}
+
+func TestXmlRoundTrip(t *testing.T) {
+	for _, c := range []XmlCodec{{}, {TagElems: true, AttrElems: true}, {Indent: "\t"}, {TagElems: true, Indent: "  "}} {
+		for _, m := range xmlSamples() {
+			buf, err := c.Encode(m)
+			if err != nil {
+				t.Fatalf("%+v %s: %v", c, CanonicalJson(m), err)
+			}
+			back, err := c.Decode(buf)
+			if err != nil {
+				t.Fatalf("%+v %s: %v", c, buf, err)
+			}
+			if !Equal(back, m) || back.PayloadType() != m.PayloadType() {
+				t.Errorf("%+v %s read back as %s", c, buf, CanonicalJson(back))
+			}
+		}
+	}
+}
+
+func TestXmlEncodeInvalid(t *testing.T) {
+	for _, c := range []struct {
+		m Meta
+		c XmlCodec
+	}{
+		{New("A").WithAttr("u", "\x01"), XmlCodec{}},
+		{New("A").WithAttr("u", "\x01"), XmlCodec{AttrElems: true}},
+		{New("A").WithTag("u", "\uFFFE"), XmlCodec{}},
+		{New("A").WithAttr("\x00", "x"), XmlCodec{}},
+		{New("A").WithPayload("bad \xff utf-8"), XmlCodec{}},
+		{New("A\x1b"), XmlCodec{}},
+		{New("A", "", "", "\x7f\x02"), XmlCodec{}},
+		{New("A").WithSub("s", New("B").WithAttr("u", "\x01")), XmlCodec{}},
+		{New("A").WithPayload(" \n").WithList([]Meta{New("B")}), XmlCodec{}},
+		{New("A").WithPayload(" \n").WithTag("t", "x"), XmlCodec{TagElems: true}},
+	} {
+		if buf, err := c.c.Encode(c.m); err == nil {
+			t.Errorf("%+v %s encoded as %s", c.c, CanonicalJson(c.m), buf)
+		} else if !strings.HasPrefix(err.Error(), "Invalid XML") {
+			t.Errorf("%s: %v", CanonicalJson(c.m), err)
+		}
+	}
+
+	// a whitespace payload without child elements is kept
+	m := New("A").WithPayload(" \n").WithTag("t", "x")
+	if buf, err := EncodeXml(m); err != nil {
+		t.Error(err)
+	} else if back, err := DecodeXml(buf); err != nil || !Equal(back, m) {
+		t.Errorf("%s read back as %v, %v", buf, back, err)
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// YAML and TOML Metas have the fields of MetaJson. Scalar tags and attrs,
+// like numbers and bools, are taken as written (YAML) or formatted back
+// (TOML); a null value is "".
+
+// SourceError reports where in the source, from line 1 and column 1, a
+// Meta could not be read; Col is 0 if unknown, and Line is 0 if only the
+// Path of the field, like "list[2].attrs.x", is known. TOML errors carry
+// the Path in any case.
+type SourceError struct {
+	Format    string
+	Line, Col int
+	Path      string
+	Msg       string
+}
+
+func (e *SourceError) Error() string {
+	if e.Line == 0 {
+		return "Invalid " + e.Format + " meta at " + e.Path + ": " + e.Msg
+	}
+	if e.Col > 0 {
+		return "Invalid " + e.Format + " meta at " + strconv.Itoa(e.Line) + ":" + strconv.Itoa(e.Col) + ": " + e.Msg
+	}
+	return "Invalid " + e.Format + " meta at line " + strconv.Itoa(e.Line) + ": " + e.Msg
+}
+
+var yamlLineError = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// ParseMetaYaml reads a Meta from a single YAML document, and fails if buf
+// holds more than one that is not empty.
+func ParseMetaYaml(buf []byte) (Meta, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(buf))
+	var doc yaml.Node
+	if err := dec.Decode(&doc); err == io.EOF {
+		return Nil, nil
+	} else if err != nil {
+		return Nil, yamlSyntaxError(err)
+	}
+	for {
+		var next yaml.Node
+		err := dec.Decode(&next)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return Nil, yamlSyntaxError(err)
+		}
+		if len(next.Content) > 0 && next.Content[0].Tag != "!!null" {
+			return Nil, yamlError(next.Content[0], "more than one document")
+		}
+	}
+	if len(doc.Content) == 0 {
+		return Nil, nil
+	}
+	return yamlMeta(doc.Content[0], 0)
+}
+
+func yamlSyntaxError(err error) error {
+	if sub := yamlLineError.FindStringSubmatch(err.Error()); sub != nil {
+		line, _ := strconv.Atoi(sub[1])
+		return &SourceError{Format: "yaml", Line: line, Msg: sub[2]}
+	}
+	return err
+}
+
+func yamlError(n *yaml.Node, msg string) error {
+	return &SourceError{Format: "yaml", Line: n.Line, Col: n.Column, Msg: msg}
+}
+
+func yamlMeta(n *yaml.Node, depth int) (Meta, error) {
+	if depth > maxTextDepth {
+		return Nil, yamlError(n, "nested too deep")
+	}
+	if n.Kind == yaml.AliasNode {
+		return yamlMeta(n.Alias, depth+1)
+	}
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!null" {
+		return Nil, nil
+	}
+	if n.Kind != yaml.MappingNode {
+		return Nil, yamlError(n, "expected a mapping")
+	}
+
+	b := &Builder{}
+	var payload, ctype, enc string
+	seen := map[string]bool{}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, val := n.Content[i], n.Content[i+1]
+		if seen[key.Value] {
+			return Nil, yamlError(key, "duplicate field "+key.Value)
+		}
+		seen[key.Value] = true
+
+		var err error
+		switch key.Value {
+		case "kind":
+			b.kind, err = yamlStr(val)
+		case "method":
+			b.mthd, err = yamlStr(val)
+		case "ns":
+			b.ns, err = yamlStr(val)
+		case "gid":
+			b.gid, err = yamlStr(val)
+		case "payload":
+			payload, err = yamlStr(val)
+		case "payloadType":
+			ctype, err = yamlStr(val)
+		case "payloadEncoding":
+			enc, err = yamlStr(val)
+		case "tags":
+			err = yamlEach(val, func(k, v *yaml.Node) error {
+				s, err := yamlStr(v)
+				b.SetTag(k.Value, s)
+				return err
+			})
+		case "attrs":
+			err = yamlEach(val, func(k, v *yaml.Node) error {
+				s, err := yamlStr(v)
+				b.SetAttr(k.Value, s)
+				return err
+			})
+		case "subs", "rels":
+			set := b.SetSub
+			if key.Value == "rels" {
+				set = b.SetRel
+			}
+			err = yamlEach(val, func(k, v *yaml.Node) error {
+				m, err := yamlMeta(v, depth+1)
+				set(k.Value, m)
+				return err
+			})
+		case "list":
+			val = yamlDeref(val)
+			if val.Kind != yaml.SequenceNode {
+				return Nil, yamlError(val, "expected a sequence")
+			}
+			for _, item := range val.Content {
+				m, err := yamlMeta(item, depth+1)
+				if err != nil {
+					return Nil, err
+				}
+				if !m.IsNil() { // as JsonToMeta
+					b.AppendList(m)
+				}
+			}
+		default:
+			err = yamlError(key, "unknown field "+key.Value)
+		}
+		if err != nil {
+			return Nil, err
+		}
+	}
+	var err error
+	if b.payload, err = decodePayload(payload, ctype, enc); err != nil {
+		return Nil, yamlError(n, "payload: "+err.Error())
+	}
+	return b.Build(), nil
+}
+
+func yamlDeref(n *yaml.Node) *yaml.Node {
+	for i := 0; n.Kind == yaml.AliasNode && i < maxTextDepth; i++ {
+		n = n.Alias
+	}
+	return n
+}
+
+func yamlStr(n *yaml.Node) (string, error) {
+	n = yamlDeref(n)
+	if n.Kind != yaml.ScalarNode {
+		return "", yamlError(n, "expected a scalar")
+	}
+	if n.Tag == "!!null" {
+		return "", nil
+	}
+	return n.Value, nil
+}
+
+// yamlEach calls fn for the entries of a mapping, or nothing for null
+func yamlEach(n *yaml.Node, fn func(k, v *yaml.Node) error) error {
+	n = yamlDeref(n)
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!null" {
+		return nil
+	}
+	if n.Kind != yaml.MappingNode {
+		return yamlError(n, "expected a mapping")
+	}
+	seen := map[string]bool{}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k := n.Content[i]
+		if seen[k.Value] {
+			return yamlError(k, "duplicate key "+k.Value)
+		}
+		seen[k.Value] = true
+		if err := fn(k, n.Content[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MetaToYaml writes m with the fields in MetaJson order; strings that would
+// read as other types are quoted.
+func MetaToYaml(m Meta) ([]byte, error) {
+	return yaml.Marshal(yamlNode(orNil(m), map[Meta]bool{}))
+}
+
+func yamlNode(m Meta, stack map[Meta]bool) *yaml.Node {
+	if m.IsNil() {
+		return &yaml.Node{Kind: yaml.MappingNode}
+	}
+	if stack[m] {
+		m = Ref(m)
+	}
+	stack[m] = true
+	defer delete(stack, m)
+
+	n := &yaml.Node{Kind: yaml.MappingNode}
+	add := func(key string, val *yaml.Node) {
+		n.Content = append(n.Content, yamlScalar(key), val)
+	}
+	addStr := func(key, val string) {
+		if val != "" {
+			add(key, yamlScalar(val))
+		}
+	}
+	addStrs := func(key string, names []string, get func(string) string) {
+		if len(names) > 0 {
+			vals := &yaml.Node{Kind: yaml.MappingNode}
+			for _, name := range names {
+				vals.Content = append(vals.Content, yamlScalar(name), yamlScalar(get(name)))
+			}
+			add(key, vals)
+		}
+	}
+	addNodes := func(key string, names []string, get func(string) Meta) {
+		if len(names) > 0 {
+			vals := &yaml.Node{Kind: yaml.MappingNode}
+			for _, name := range names {
+				vals.Content = append(vals.Content, yamlScalar(name), yamlNode(get(name), stack))
+			}
+			add(key, vals)
+		}
+	}
+
+	addStr("kind", m.Kind())
+	addStr("method", m.Method())
+	addStr("ns", m.Ns())
+	addStr("gid", m.Gid())
+	addStrs("tags", m.TagNames(), m.Tag)
+	addStrs("attrs", m.AttrNames(), func(name string) string { return m.Attr(name) })
+	if payload, ctype, enc := encodePayload(m); payload != "" {
+		node := yamlScalar(payload)
+		if ctype == "" {
+			node.Style = yaml.LiteralStyle
+		}
+		add("payload", node)
+		addStr("payloadType", ctype)
+		addStr("payloadEncoding", enc)
+	}
+	addNodes("subs", m.SubNames(), m.Sub)
+	addNodes("rels", m.RelNames(), m.Rel)
+	if list := m.List(); len(list) > 0 {
+		items := &yaml.Node{Kind: yaml.SequenceNode}
+		for _, item := range list {
+			items.Content = append(items.Content, yamlNode(item, stack))
+		}
+		add("list", items)
+	}
+	return n
+}
+
+func yamlScalar(s string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: s}
+}
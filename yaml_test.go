@@ -0,0 +1,32 @@
+// Copyright (c) 2022 Jing-Ying Chen. MIT License. See https://github.com/jyrobin/mp
+
+package mp
+
+import (
+	"testing"
+)
+
+func TestParseMetaYamlDocuments(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want Meta
+		line int // of the error if not 0
+	}{
+		{"", Nil, 0},
+		{"---\n", Nil, 0},
+		{"kind: A\n", New("A"), 0},
+		{"kind: A\n---\n...\n", New("A"), 0},
+		{"kind: A\n---\n~\n", New("A"), 0},
+		{"kind: A\n---\nkind: B\n", nil, 3},
+		{"---\n---\nkind: B\n", nil, 3},
+	} {
+		m, err := ParseMetaYaml([]byte(c.in))
+		if c.line == 0 {
+			if err != nil || !Equal(m, c.want) {
+				t.Errorf("%q: got %v, %v", c.in, m, err)
+			}
+		} else if se, ok := err.(*SourceError); !ok || se.Line != c.line {
+			t.Errorf("%q: got %v", c.in, err)
+		}
+	}
+}